@@ -0,0 +1,103 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrWorkersBusy 等待 worker 的事件数量达到 WorkerQueue，TriggerAsync 不再接收新的事件
+var ErrWorkersBusy = errors.New("worker 已满，等待的事件过多")
+
+// DefaultWorkerQueue 默认最多等待 worker 的事件数量
+const DefaultWorkerQueue = 1024
+
+// Workers 限制 TriggerAsync 同时执行的事件数量，n <= 0 或者没有设置时不限制
+func Workers(n int) Option {
+	return func(machine *StateMachine) {
+		machine.workers = nil
+		if n > 0 {
+			machine.workers = make(chan struct{}, n)
+		}
+	}
+}
+
+// WorkerQueue 设置了 Workers 时最多等待 worker 的事件数量，默认 DefaultWorkerQueue，n <= 0 时不限制
+func WorkerQueue(n int) Option {
+	return func(machine *StateMachine) {
+		machine.workerQueue = n
+	}
+}
+
+// TriggerAsync 在后台执行 Trigger，立即返回。
+// 没有空闲的 worker 时在后台等待，等待的时候 ctx 结束时不再执行，Future 的错误为 ErrCancelled；
+// 等待的事件达到 WorkerQueue 时 Future 立即失败，错误为 ErrWorkersBusy。执行以后 ctx 传递给条件和动作
+func (o *StateMachine) TriggerAsync(c context.Context, entity Entity, event Event) *Future {
+	future := newFuture()
+	if o.workers == nil {
+		go func() {
+			future.finish(o.trigger(c, entity, event))
+		}()
+		return future
+	}
+	if waiting := atomic.AddInt32(&o.waiting, 1); o.workerQueue > 0 && int(waiting) > o.workerQueue {
+		atomic.AddInt32(&o.waiting, -1)
+		future.finish(nil, ErrWorkersBusy)
+		return future
+	}
+	go func() {
+		select {
+		case o.workers <- struct{}{}:
+			atomic.AddInt32(&o.waiting, -1)
+			defer func() { <-o.workers }()
+		case <-c.Done():
+			atomic.AddInt32(&o.waiting, -1)
+			future.finish(nil, cancelled(c, entity, entity.State(), event))
+			return
+		}
+		future.finish(o.trigger(c, entity, event))
+	}()
+	return future
+}
+
+// Future 异步执行的事件的结果
+type Future struct {
+	done  chan struct{}
+	trans *Transition
+	err   error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (o *Future) finish(trans *Transition, err error) {
+	o.trans, o.err = trans, err
+	close(o.done)
+}
+
+// Done 事件执行完成以后关闭
+func (o *Future) Done() <-chan struct{} {
+	return o.done
+}
+
+// Result 事件执行的转换和错误，Done 关闭以前都为 nil。
+// 转换不包括随后的完成转换和重新分发的延迟事件，事件被延迟时为 nil；动作执行失败时为执行的转换
+func (o *Future) Result() (*Transition, error) {
+	select {
+	case <-o.done:
+		return o.trans, o.err
+	default:
+		return nil, nil
+	}
+}
+
+// Wait 等待事件执行完成，ctx 结束时返回 ctx.Err()，事件仍然会执行
+func (o *Future) Wait(ctx context.Context) (*Transition, error) {
+	select {
+	case <-o.done:
+		return o.trans, o.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,60 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"testing"
+)
+
+func TestStateMachine_TriggerAsync(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	sm := NewMachine("TestStateMachine_TriggerAsync", Machines(nil), Workers(1), WorkerQueue(1))
+	sm.Trans(State("s1").Exit("e1", ""), State("s2").Entry("", func(ctx context.Context, entity Entity, from, to IState) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}))
+
+	entity := NewMutableTestEntity("1", State("s1"))
+	future := sm.TriggerAsync(context.Background(), entity, "e1")
+	<-started
+	trans, err := future.Result()
+	goassert.That(t, trans == nil && err == nil).Equal(true)
+
+	// 唯一的 worker 正在执行，TriggerAsync 立即返回，在后台等待 worker
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := sm.TriggerAsync(ctx, NewMutableTestEntity("2", State("s1")), "e1")
+	trans, err = queued.Result()
+	goassert.That(t, trans == nil && err == nil).Equal(true)
+
+	// 等待的事件达到 WorkerQueue 时立即失败
+	_, err = sm.TriggerAsync(context.Background(), NewMutableTestEntity("3", State("s1")), "e1").Result()
+	goassert.That(t, err).Equal(ErrWorkersBusy)
+
+	// 等待 worker 的时候 ctx 结束，事件不再执行
+	cancel()
+	_, err = queued.Wait(context.Background())
+	goassert.That(t, errors.Is(err, ErrCancelled)).Equal(true)
+	goassert.That(t, errors.Is(err, context.Canceled)).Equal(true)
+
+	close(release)
+	trans, err = future.Wait(context.Background())
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, trans.From.ID()).Equal("s1")
+	goassert.That(t, trans.To.ID()).Equal("s2")
+	goassert.That(t, entity.s.ID()).Equal("s2")
+
+	_, err = sm.TriggerAsync(context.Background(), entity, "e1").Wait(context.Background())
+	goassert.That(t, errors.Is(err, ErrUnknownState)).Equal(true)
+}
+
+func TestWorkers_Unlimited(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		sm := NewMachine("TestWorkers_Unlimited", Machines(nil), Workers(n))
+		sm.Trans(State("s1").Exit("e1", ""), State("s2").Entry(""))
+		_, err := sm.TriggerAsync(context.Background(), NewMutableTestEntity("1", State("s1")), "e1").Wait(context.Background())
+		goassert.That(t, err).Equal(nil)
+	}
+}
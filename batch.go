@@ -0,0 +1,95 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// BatchOptions TriggerBatch 的选项
+type BatchOptions struct {
+	// Parallelism 同时执行的实体数量，默认为 runtime.NumCPU()
+	Parallelism int
+	// StopOnError 第一个实体失败以后不再执行剩余的实体，剩余实体的错误为 ErrBatchSkipped
+	StopOnError bool
+}
+
+// BatchResult 一个实体的执行结果
+type BatchResult struct {
+	EntityID   string
+	Transition *Transition
+	Err        error
+}
+
+// BatchError 部分实体执行失败，Failed 按照实体的顺序排列
+type BatchError struct {
+	Total  int
+	Failed []*BatchResult
+}
+
+func (o *BatchError) Error() string {
+	first := o.Failed[0]
+	return fmt.Sprintf("%d 个实体中 %d 个执行失败，第一个错误: [%s] %v", o.Total, len(o.Failed), first.EntityID, first.Err)
+}
+
+// ErrBatchSkipped StopOnError 时因为其它实体失败没有执行
+var ErrBatchSkipped = errors.New("其它实体执行失败，没有执行")
+
+// TriggerBatch 对多个实体执行同一个事件，结果按照 entities 的顺序排列。
+// 每个实体使用 Trigger 执行（包括 LockerFactory 的锁），存在失败的实体时返回 *BatchError；
+// ctx 结束以后没有开始的实体不再执行，错误为 ErrCancelled
+func (o *StateMachine) TriggerBatch(c context.Context, entities []Entity, event Event, opts BatchOptions) ([]*BatchResult, error) {
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+	if parallelism > len(entities) {
+		parallelism = len(entities)
+	}
+
+	// worker 执行完一个实体以后领取下一个下标，慢的实体不会阻塞其它实体
+	results := make([]*BatchResult, len(entities))
+	var next int64 = -1
+	var stop sync.Once
+	stopped := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(entities) {
+					return
+				}
+				entity := entities[i]
+				result := &BatchResult{EntityID: entity.ID()}
+				select {
+				case <-stopped:
+					result.Err = ErrBatchSkipped
+				default:
+					result.Transition, result.Err = o.trigger(c, entity, event)
+				}
+				if result.Err != nil && opts.StopOnError {
+					stop.Do(func() { close(stopped) })
+				}
+				results[i] = result
+			}
+		}()
+	}
+	wg.Wait()
+
+	batchErr := &BatchError{Total: len(entities)}
+	for _, result := range results {
+		if result.Err != nil {
+			batchErr.Failed = append(batchErr.Failed, result)
+		}
+	}
+	if len(batchErr.Failed) > 0 {
+		return results, batchErr
+	}
+	return results, nil
+}
@@ -0,0 +1,135 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/threeq/goassert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func batchMachine(name string, options ...Option) *StateMachine {
+	sm := NewMachine(name, append([]Option{Machines(nil)}, options...)...)
+	sm.Trans(State("active").Exit("expire", ""), State("expired").Entry(""))
+	return sm
+}
+
+func batchEntities(n int) []Entity {
+	entities := make([]Entity, n)
+	for i := range entities {
+		entities[i] = NewMutableTestEntity(fmt.Sprint(i), State("active"))
+	}
+	return entities
+}
+
+func TestStateMachine_TriggerBatch(t *testing.T) {
+	sm := batchMachine("TestStateMachine_TriggerBatch", Locker(&mutexLocker{}))
+	entities := batchEntities(100)
+	entities[3] = NewMutableTestEntity("3", State("expired"))
+	entities[7] = NewMutableTestEntity("7", State("unknown"))
+
+	results, err := sm.TriggerBatch(context.Background(), entities, "expire", BatchOptions{Parallelism: 8})
+	var batchErr *BatchError
+	goassert.That(t, errors.As(err, &batchErr)).Equal(true)
+	goassert.That(t, batchErr.Total).Equal(100)
+	goassert.That(t, len(batchErr.Failed)).Equal(2)
+	goassert.That(t, batchErr.Failed[0].EntityID).Equal("3")
+	goassert.That(t, errors.Is(batchErr.Failed[1].Err, ErrUnknownState)).Equal(true)
+
+	goassert.That(t, len(results)).Equal(100)
+	for i, result := range results {
+		goassert.That(t, result.EntityID).Equal(fmt.Sprint(i))
+		if i != 3 && i != 7 {
+			goassert.That(t, result.Err).Equal(nil)
+			goassert.That(t, result.Transition.To.ID()).Equal("expired")
+			goassert.That(t, entities[i].State().ID()).Equal("expired")
+		}
+	}
+
+	results, err = sm.TriggerBatch(context.Background(), batchEntities(5), "expire", BatchOptions{})
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, len(results)).Equal(5)
+}
+
+func TestStateMachine_TriggerBatchStop(t *testing.T) {
+	var executed int32
+	sm := NewMachine("TestStateMachine_TriggerBatchStop", Machines(nil))
+	sm.Trans(State("active").Exit("expire", ""), State("expired").Entry("", func(ctx context.Context, entity Entity, from, to IState) error {
+		atomic.AddInt32(&executed, 1)
+		return errors.New("failed")
+	}))
+
+	results, err := sm.TriggerBatch(context.Background(), batchEntities(10), "expire", BatchOptions{Parallelism: 1, StopOnError: true})
+	goassert.That(t, err).NotEqual(nil)
+	goassert.That(t, atomic.LoadInt32(&executed)).Equal(int32(1))
+	goassert.That(t, errors.Is(results[0].Err, ErrActionFailed)).Equal(true)
+	goassert.That(t, results[9].Err).Equal(ErrBatchSkipped)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err = sm.TriggerBatch(ctx, batchEntities(3), "expire", BatchOptions{})
+	goassert.That(t, err).NotEqual(nil)
+	goassert.That(t, errors.Is(results[2].Err, ErrCancelled)).Equal(true)
+	goassert.That(t, errors.Is(results[2].Err, context.Canceled)).Equal(true)
+	goassert.That(t, atomic.LoadInt32(&executed)).Equal(int32(1))
+}
+
+func TestStateMachine_TriggerBatchSlow(t *testing.T) {
+	var done int32
+	others := make(chan struct{})
+	sm := NewMachine("TestStateMachine_TriggerBatchSlow", Machines(nil))
+	sm.Trans(State("active").Exit("expire", ""), State("expired").Entry("", func(ctx context.Context, entity Entity, from, to IState) error {
+		if entity.ID() != "0" {
+			if atomic.AddInt32(&done, 1) == 15 {
+				close(others)
+			}
+			return nil
+		}
+		// 实体 0 执行期间其它 worker 继续执行剩余的实体
+		select {
+		case <-others:
+			return nil
+		case <-time.After(time.Second):
+			return errors.New("其它实体被阻塞")
+		}
+	}))
+
+	_, err := sm.TriggerBatch(context.Background(), batchEntities(16), "expire", BatchOptions{Parallelism: 4})
+	goassert.That(t, err).Equal(nil)
+}
+
+// benchMachine 动作模拟一次 100µs 的 I/O（例如写数据库）
+func benchMachine(name string) *StateMachine {
+	sm := NewMachine(name, Machines(nil), Locker(&mutexLocker{}))
+	sm.Trans(State("active").Exit("expire", ""), State("expired").Entry("", func(ctx context.Context, entity Entity, from, to IState) error {
+		time.Sleep(100 * time.Microsecond)
+		return nil
+	}))
+	return sm
+}
+
+func BenchmarkStateMachine_Trigger(b *testing.B) {
+	sm := benchMachine("BenchmarkStateMachine_Trigger")
+	entities := batchEntities(b.N)
+	b.ResetTimer()
+	for _, entity := range entities {
+		if err := sm.Trigger(context.Background(), entity, "expire"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStateMachine_TriggerBatch(b *testing.B) {
+	for _, parallelism := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("parallelism-%d", parallelism), func(b *testing.B) {
+			sm := benchMachine(fmt.Sprintf("BenchmarkStateMachine_TriggerBatch_%d", parallelism))
+			entities := batchEntities(b.N)
+			b.ResetTimer()
+			if _, err := sm.TriggerBatch(context.Background(), entities, "expire", BatchOptions{Parallelism: parallelism}); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
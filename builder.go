@@ -1,9 +1,14 @@
 package gosm
 
-var stateMachines = make(map[string]*StateMachine)
+import "strings"
 
 type Builder struct {
 	transitions []*transCfg
+	states      map[string]*state
+	deferrals   map[string][]Event
+	registry    *Registry
+	machines    *MachineRegistry
+	strict      bool
 }
 
 func (o *Builder) Transition() *transition {
@@ -12,23 +17,211 @@ func (o *Builder) Transition() *transition {
 	}}
 }
 
+// Build 创建状态机，名字重复或者 Strict 校验失败时 panic
 func (o *Builder) Build(machineID string, options ...Option) *StateMachine {
-	sm := NewMachine(machineID, options...)
+	sm, err := o.TryBuild(machineID, options...)
+	if err != nil {
+		panic(err)
+	}
+	return sm
+}
+
+// Strict 创建状态机以后执行 StateMachine.Validate，存在 Error 级别的问题时创建失败
+func (o *Builder) Strict(strict bool) *Builder {
+	o.strict = strict
+	return o
+}
+
+// TryBuild 创建状态机，名字重复时返回 *ErrDuplicateMachine，Strict 校验失败时返回 *ValidationError
+func (o *Builder) TryBuild(machineID string, options ...Option) (*StateMachine, error) {
+	if o.machines != nil {
+		options = append([]Option{Machines(o.machines)}, options...)
+	}
+	sm, err := TryNewMachine(machineID, options...)
+	if err != nil {
+		return nil, err
+	}
 	for _, cfg := range o.transitions {
 		for _, s1 := range cfg.from {
-			sm.Trans(s1.Exit(cfg.event, cfg.condDesc, cfg.condition),
-				cfg.to.Entry(cfg.actionDesc, cfg.action))
+			exit := s1.Exit(cfg.event, cfg.condDesc, cfg.condition)
+			switch {
+			case cfg.fork != nil:
+				var entries []StateEntry
+				for _, branch := range cfg.fork.branches {
+					entries = append(entries, branch.target().Entry(branch.actionDesc, branch.action))
+				}
+				fork := sm.Fork(exit).Desc(cfg.fork.desc).Link(cfg.fork.executor, entries...)
+				if j := cfg.fork.join; j != nil {
+					var finals []IState
+					for _, f := range j.finals {
+						finals = append(finals, f)
+					}
+					fork.Join(j.desc, finals...).Quorum(j.quorum).
+						Link(j.target.target().Entry(j.target.actionDesc, j.target.action))
+				}
+			case cfg.internal:
+				sm.Internal(exit, cfg.actionDesc, cfg.action)
+			case cfg.end:
+				sm.Trans(exit, sm.end(cfg.actionDesc, cfg.action))
+			default:
+				sm.Trans(exit, cfg.entry())
+			}
 		}
 	}
 
-	stateMachines[machineID] = sm
+	for id, events := range o.deferrals {
+		sm.Defer(o.state(id), events...)
+	}
 
+	// 状态绑定到了 sm，下一次 Build 重新创建
 	o.transitions = []*transCfg{}
-	return sm
+	o.states = nil
+	o.deferrals = nil
+	if o.strict {
+		if err := sm.Validate().Err(); err != nil {
+			if sm.machines != nil {
+				sm.machines.Unregister(sm.Name)
+			}
+			return nil, err
+		}
+	}
+	return sm, nil
+}
+
+// Machines 指定状态机注册表，用来注册创建的状态机以及查找链接的子状态机，默认 DefaultMachines
+func (o *Builder) Machines(machines *MachineRegistry) *Builder {
+	o.machines = machines
+	return o
+}
+
+func (o *Builder) getMachines() *MachineRegistry {
+	if o.machines == nil {
+		return DefaultMachines
+	}
+	return o.machines
+}
+
+// Registry 指定解析名字使用的注册表，默认使用继承 DefaultRegistry 的私有注册表
+func (o *Builder) Registry(registry *Registry) *Builder {
+	o.registry = registry
+	return o
+}
+
+func (o *Builder) getRegistry() *Registry {
+	if o.registry == nil {
+		o.registry = NewRegistry(DefaultRegistry)
+	}
+	return o.registry
+}
+
+// Condition 注册 DSL 中 guard 引用的条件
+func (o *Builder) Condition(name string, cond Condition) *Builder {
+	o.getRegistry().RegisterCondition(name, cond)
+	return o
+}
+
+// Action 注册 DSL 中 action 引用的动作
+func (o *Builder) Action(name string, action Action) *Builder {
+	o.getRegistry().RegisterAction(name, action)
+	return o
+}
+
+// Executor 注册 DSL 中 fork 引用的执行器
+func (o *Builder) Executor(name string, executor Executor) *Builder {
+	o.getRegistry().RegisterExecutor(name, executor)
+	return o
+}
+
+// DSL 解析 DSL 文本并加入到 Builder 的转换列表中，语法见 dsl.go。
+// 引用的名字没有注册时返回 *UnknownNamesError
+func (o *Builder) DSL(dsl string) error {
+	file, err := parseDSL(dsl)
+	if err != nil {
+		return err
+	}
+
+	declared := make(map[string]bool)
+	for _, s := range file.states {
+		if declared[s.id] {
+			return s.pos.errorf("状态 %s 重复声明", s.id)
+		}
+		declared[s.id] = true
+		o.state(s.id).stereotype = s.stereotype
+		o.deferEvents(s.id, s.deferrals)
+	}
+
+	resolver := &nameResolver{registry: o.getRegistry(), machines: o.getMachines()}
+	var transitions []*transCfg
+	for _, t := range file.trans {
+		transitions = append(transitions, o.dslTransCfg(resolver, t))
+	}
+	if err := resolver.err(); err != nil {
+		return err
+	}
+	o.transitions = append(o.transitions, transitions...)
+	return nil
+}
+
+func (o *Builder) dslTransCfg(resolver *nameResolver, t *dslTrans) *transCfg {
+	cfg := &transCfg{builder: o, event: eventOf(t.event), actionDesc: t.action.value}
+	for _, id := range t.from {
+		cfg.from = append(cfg.from, o.state(id))
+	}
+	cfg.condition, cfg.condDesc = resolver.condition(t.guard.value, t.guard.pos)
+	cfg.action = resolver.action(t.action.value, t.action.pos)
+
+	switch {
+	case t.branches != nil:
+		var names []string
+		for _, name := range t.executor {
+			names = append(names, name.value)
+		}
+		cfg.fork = &forkCfg{
+			executor: resolver.executor(names, t.executor[0].pos),
+			desc:     strings.Join(names, ","),
+		}
+		for _, b := range t.branches {
+			cfg.fork.branches = append(cfg.fork.branches, &transCfg{
+				builder:    o,
+				to:         o.state(b.to),
+				action:     resolver.action(b.action.value, b.action.pos),
+				actionDesc: b.action.value,
+			})
+		}
+	case t.internal:
+		cfg.internal = true
+	case t.to == "[*]":
+		cfg.end = true
+	default:
+		cfg.to = o.state(t.to)
+	}
+	return cfg
 }
 
-func (o *Builder) DSL(dsl string) {
-	//TODO DSL 支持
+// state 同一个 Builder 中相同 ID 的状态使用同一个对象
+func (o *Builder) state(id string) *state {
+	if o.states == nil {
+		o.states = make(map[string]*state)
+	}
+	s, has := o.states[id]
+	if !has {
+		s = &state{value: id}
+		o.states[id] = s
+	}
+	return s
+}
+
+// deferEvents 状态 id 延迟的事件
+func (o *Builder) deferEvents(id string, events []string) {
+	if len(events) == 0 {
+		return
+	}
+	if o.deferrals == nil {
+		o.deferrals = make(map[string][]Event)
+	}
+	for _, event := range events {
+		o.deferrals[id] = append(o.deferrals[id], event)
+	}
 }
 
 func (o *Builder) addTransition(trans *transCfg) {
@@ -48,6 +241,44 @@ type transCfg struct {
 	builder    *Builder
 	actionDesc string
 	condDesc   string
+	end        bool
+	fork       *forkCfg
+	link       *StateMachine
+	history    string
+	internal   bool
+}
+
+// target 链接到子状态机时使用子状态机中的状态
+func (o *transCfg) target() IState {
+	if o.link != nil {
+		return o.link.State(o.to.ID())
+	}
+	return o.to
+}
+
+// entry 目标为 [H]、[H*] 时进入链接的状态机的历史入口
+func (o *transCfg) entry() StateEntry {
+	switch o.history {
+	case "[H]":
+		return o.link.ShallowHistory(o.actionDesc, o.action)
+	case "[H*]":
+		return o.link.DeepHistory(o.actionDesc, o.action)
+	}
+	return o.target().Entry(o.actionDesc, o.action)
+}
+
+type forkCfg struct {
+	executor Executor
+	desc     string
+	branches []*transCfg
+	join     *joinCfg
+}
+
+type joinCfg struct {
+	desc   string
+	finals []*state
+	quorum int
+	target *transCfg
 }
 
 type transition struct {
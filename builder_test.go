@@ -1,19 +1,48 @@
 package gosm
 
-//func TestStateMachine(t *testing.T) {
-//	builder := gosm.NewBuilder()
-//	builder.Trans().
-//		From("").
-//		To("").
-//		On("").
-//		When("Any", gosm.Any).
-//		Action("", func(ctx context.Context, entity gosm.Entity, from, to gosm.state) error {
-//			return nil
-//		})
-//	builder.Build("machineID")
-//	machine := gosm.Get("machineID")
-//
-//	event := ""
-//	entity := NewTestEntity("t1", "s1")
-//	machine.Trigger(context.Background(), entity, event)
-//}
+import (
+	"context"
+	"github.com/threeq/goassert"
+	"testing"
+)
+
+func TestBuilder_Build(t *testing.T) {
+	builder := NewBuilder()
+	builder.Transition().
+		From(&state{value: "s1"}).
+		To(&state{value: "s2"}).
+		On("e1").
+		When("Any", Any).
+		Action("", func(ctx context.Context, entity Entity, from, to IState) error {
+			entity.(*TestEntity).s = to
+			return nil
+		})
+	builder.Build("TestBuilder_Build")
+	machine := Get("TestBuilder_Build")
+	goassert.That(t, machine).NotEqual(nil)
+
+	entity := NewTestEntity("t1", State("s1"))
+	err := machine.Trigger(context.Background(), entity, "e1")
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("s2")
+}
+
+func TestBuilder_Reuse(t *testing.T) {
+	var entered []string
+	builder := NewBuilder().Machines(NewMachineRegistry())
+	goassert.That(t, builder.DSL("s1 -> s2 : e1")).Equal(nil)
+	first := builder.Build("TestBuilder_Reuse_first")
+	first.OnEntry(first.State("s2"), func(ctx context.Context, entity Entity, from, to IState) error {
+		entered = append(entered, "first")
+		return nil
+	})
+
+	goassert.That(t, builder.DSL("s1 -> s2 : e2")).Equal(nil)
+	second := builder.Build("TestBuilder_Reuse_second")
+
+	goassert.That(t, len(first.States())).Equal(2)
+	goassert.That(t, first.State("s2").Machine()).Equal(first)
+	goassert.That(t, second.State("s2").Machine()).Equal(second)
+	goassert.That(t, first.Trigger(context.Background(), NewMutableTestEntity("1", State("s1")), "e1")).Equal(nil)
+	goassert.That(t, entered).Equal([]string{"first"})
+}
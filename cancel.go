@@ -0,0 +1,55 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// cancelled ctx 已经结束时返回 ErrCancelled，Cause 为 ctx.Err()
+func cancelled(c context.Context, entity Entity, state IState, event Event) error {
+	if err := c.Err(); err != nil {
+		return &TriggerError{Kind: ErrCancelled, EntityID: entity.ID(), State: state, Event: event, Cause: err}
+	}
+	return nil
+}
+
+// actionKind 动作因为 ctx 结束失败时为 ErrCancelled，否则为 ErrActionFailed
+func actionKind(c context.Context, cause error) error {
+	if c.Err() != nil && (errors.Is(cause, context.Canceled) || errors.Is(cause, context.DeadlineExceeded)) {
+		return ErrCancelled
+	}
+	return ErrActionFailed
+}
+
+// executed 转换的动作已经执行（执行失败或者执行中取消），需要调用 Filter.After
+func executed(trans *Transition, err error) bool {
+	return trans != nil && (errors.Is(err, ErrActionFailed) || errors.Is(err, ErrCancelled))
+}
+
+// lockContext 获取锁，ctx 先结束时返回 ctx.Err()。
+// 锁不是 ContextLocker 时在其它 goroutine 中等待，放弃以后获取到的锁由这个 goroutine 释放
+func lockContext(c context.Context, locker sync.Locker) error {
+	if l, ok := locker.(ContextLocker); ok {
+		return l.LockContext(c)
+	}
+	if c.Done() == nil {
+		locker.Lock()
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		locker.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-c.Done():
+		go func() {
+			<-locked
+			locker.Unlock()
+		}()
+		return c.Err()
+	}
+}
@@ -0,0 +1,207 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStateMachine_TriggerCancelled(t *testing.T) {
+	var checked []string
+	guard := func(name string, cancel context.CancelFunc) Condition {
+		return func(ctx context.Context, entity Entity, from, to IState) bool {
+			checked = append(checked, name)
+			if cancel != nil {
+				cancel()
+			}
+			return false
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	failed := errors.New("failed")
+	filter := &testTransFilter{}
+	sm := NewMachine("TestStateMachine_TriggerCancelled", Machines(nil), Aspect(filter))
+	sm.Trans(State("s1").Exit("e1", "g1", guard("g1", cancel)), State("s2").Entry(""))
+	sm.Trans(State("s1").Exit("e1", "g2", guard("g2", nil)), State("s3").Entry(""))
+	sm.Trans(State("s1").Exit("e2", ""), State("s2").Entry("", func(ctx context.Context, entity Entity, from, to IState) error {
+		cancel()
+		return ctx.Err()
+	}))
+	sm.Trans(State("s1").Exit("e3", ""), State("s2").Entry("", func(ctx context.Context, entity Entity, from, to IState) error {
+		return failed
+	}))
+
+	// 条件检查中取消，后面的条件不再检查
+	entity := NewMutableTestEntity("1", State("s1"))
+	err := sm.Trigger(ctx, entity, "e1")
+	goassert.That(t, errors.Is(err, ErrCancelled)).Equal(true)
+	goassert.That(t, errors.Is(err, context.Canceled)).Equal(true)
+	goassert.That(t, checked).Equal([]string{"g1"})
+
+	err = sm.Trigger(ctx, entity, "e3")
+	goassert.That(t, errors.Is(err, ErrCancelled)).Equal(true)
+	goassert.That(t, len(filter.trans)).Equal(0)
+
+	// 动作中取消
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	err = sm.Trigger(ctx, entity, "e2")
+	goassert.That(t, errors.Is(err, ErrCancelled)).Equal(true)
+	goassert.That(t, errors.Is(err, ErrActionFailed)).Equal(false)
+	goassert.That(t, entity.s.ID()).Equal("s1")
+	goassert.That(t, len(filter.trans)).Equal(1)
+
+	// 没有取消时动作的错误仍然为 ErrActionFailed
+	err = sm.Trigger(context.Background(), entity, "e3")
+	goassert.That(t, errors.Is(err, ErrActionFailed)).Equal(true)
+}
+
+func TestStateMachine_TriggerLockCancelled(t *testing.T) {
+	locker := &mutexLocker{}
+	sm := NewMachine("TestStateMachine_TriggerLockCancelled", Machines(nil), Locker(locker))
+	sm.Trans(State("s1").Exit("e1", ""), State("s2").Entry(""))
+
+	entity := NewMutableTestEntity("1", State("s1"))
+	held := locker.New("1")
+	held.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := sm.Trigger(ctx, entity, "e1")
+	goassert.That(t, errors.Is(err, ErrCancelled)).Equal(true)
+	goassert.That(t, errors.Is(err, context.DeadlineExceeded)).Equal(true)
+	goassert.That(t, entity.s.ID()).Equal("s1")
+
+	// 放弃等待的锁获取以后自动释放
+	held.Unlock()
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e1")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("s2")
+}
+
+// chanLocker 使用 channel 实现的 ContextLocker
+type chanLocker struct {
+	ch      chan struct{}
+	waiting int32
+}
+
+func (o *chanLocker) New(id string) sync.Locker {
+	return o
+}
+
+func (o *chanLocker) Lock() {
+	panic("应该使用 LockContext")
+}
+
+func (o *chanLocker) LockContext(ctx context.Context) error {
+	atomic.AddInt32(&o.waiting, 1)
+	select {
+	case o.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (o *chanLocker) Unlock() {
+	<-o.ch
+}
+
+func TestStateMachine_TriggerContextLocker(t *testing.T) {
+	locker := &chanLocker{ch: make(chan struct{}, 1)}
+	sm := NewMachine("TestStateMachine_TriggerContextLocker", Machines(nil), Locker(locker))
+	sm.Trans(State("s1").Exit("e1", ""), State("s2").Entry(""))
+
+	entity := NewMutableTestEntity("1", State("s1"))
+	locker.ch <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := sm.Trigger(ctx, entity, "e1")
+	goassert.That(t, errors.Is(err, ErrCancelled)).Equal(true)
+	goassert.That(t, errors.Is(err, context.DeadlineExceeded)).Equal(true)
+
+	// 放弃等待时没有获取锁，不需要释放
+	locker.Unlock()
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e1")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("s2")
+	goassert.That(t, atomic.LoadInt32(&locker.waiting)).Equal(int32(2))
+	goassert.That(t, len(locker.ch)).Equal(0)
+}
+
+func TestStateMachine_ForkCancelled(t *testing.T) {
+	executed := make(chan string, 4)
+	blocking := func(name string) Action {
+		return func(ctx context.Context, entity Entity, from, to IState) error {
+			executed <- name
+			<-ctx.Done()
+			return ctx.Err()
+		}
+	}
+	tests := []struct {
+		name     string
+		executor Executor
+		executed int
+	}{
+		{"Serial/All", Serial(All), 1},
+		{"Serial/AllFast", Serial(AllFast), 1},
+		{"Parallel/All", Parallel(All), 2},
+		{"Parallel/OneFast", Parallel(OneFast), 2},
+		{"Parallel/One", Parallel(One), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := NewMachine("TestStateMachine_ForkCancelled", Machines(nil))
+			sm.Fork(State("s1").Exit("e1", "")).
+				Link(tt.executor, State("r1").Entry("", blocking("r1")), State("r2").Entry("", blocking("r2")))
+
+			entity := NewMutableTestEntity("1", State("s1"))
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			err := sm.Trigger(ctx, entity, "e1")
+			goassert.That(t, errors.Is(err, ErrCancelled)).Equal(true)
+			goassert.That(t, entity.s.ID()).Equal("s1")
+			for i := 0; i < tt.executed; i++ {
+				<-executed
+			}
+			goassert.That(t, len(executed)).Equal(0)
+		})
+	}
+}
+
+func TestParallel_CancelSiblings(t *testing.T) {
+	tests := []struct {
+		name     string
+		executor Executor
+		err      error
+	}{
+		{"AllFast", Parallel(AllFast), errors.New("err1")},
+		{"OneFast", Parallel(OneFast), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			cancelled := make(chan error, 1)
+			sibling := State("r1").Entry("", func(ctx context.Context, entity Entity, from, to IState) error {
+				close(started)
+				select {
+				case <-ctx.Done():
+					cancelled <- ctx.Err()
+				case <-time.After(time.Second):
+					cancelled <- nil
+				}
+				return ctx.Err()
+			})
+			decider := State("r2").Entry("", func(ctx context.Context, entity Entity, from, to IState) error {
+				<-started
+				return tt.err
+			})
+
+			err := tt.executor(context.Background(), NewTestEntity("1", State("s1")), State("s1"), []StateEntry{sibling, decider})
+			goassert.That(t, err).Equal(tt.err)
+			// 策略已经有结果，还在执行的分支收到取消
+			goassert.That(t, <-cancelled).Equal(context.Canceled)
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+)
+
+// Completion 完成转换（没有事件的转换）使用的事件。
+// Trigger 进入新的状态以后立即检查新状态的完成转换，条件通过时继续转换，直到没有可以执行的完成转换
+//
+//	sm.Trans(State("checking").Exit(gosm.Completion, "passed", passed), State("approved").Entry(""))
+var Completion Event = completionEvent{}
+
+type completionEvent struct{}
+
+func (completionEvent) String() string {
+	return ""
+}
+
+// DefaultCompletionLimit 一次 Trigger 中连续执行完成转换的默认最大次数
+const DefaultCompletionLimit = 100
+
+// CompletionLimit 一次 Trigger 中连续执行完成转换的最大次数，超过时返回 ErrCompletionLoop
+func CompletionLimit(n int) Option {
+	return func(machine *StateMachine) {
+		machine.completionLimit = n
+	}
+}
+
+// eventOf DSL、Definition 中的事件名，空字符串为 Completion
+func eventOf(name string) Event {
+	if name == "" {
+		return Completion
+	}
+	return name
+}
+
+// complete 从 state 开始执行完成转换，每次转换单独提交，返回实体最后的状态。
+// 执行内部的完成转换以后停止
+func (o *StateMachine) complete(c context.Context, entity Entity, state IState) (IState, error) {
+	for i := 0; o.completable(state); i++ {
+		if err := cancelled(c, entity, state, Completion); err != nil {
+			return state, err
+		}
+		if i >= o.completionLimit {
+			return state, &TriggerError{Kind: ErrCompletionLoop, EntityID: entity.ID(), State: state, Event: Completion}
+		}
+		trans, rejected, err := o.fire(c, entity, state, Completion, false)
+		if errors.Is(err, ErrUnknownEvent) || errors.Is(err, ErrNoGuardPassed) {
+			return state, nil
+		}
+		if err != nil {
+			if executed(trans, err) {
+				_ = o.filter.After(c, entity, trans, err)
+			}
+			return state, err
+		}
+		if err := o.commit(c, entity, state, Completion, trans, rejected); err != nil {
+			return state, err
+		}
+		if trans.Internal {
+			// 内部转换没有进入新的状态，每次进入状态只执行一次
+			return state, nil
+		}
+		state = trans.To
+	}
+	return state, nil
+}
+
+// completable 状态（包括外层的组合状态和并发区域）是否定义了完成转换
+func (o *StateMachine) completable(state IState) bool {
+	for _, l := range activeLevels(state, o) {
+		if len(l.machine.transitions[l.state.ID()][Completion]) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"testing"
+)
+
+func TestStateMachine_Completion(t *testing.T) {
+	var records []string
+	record := func(name string) Action {
+		return func(ctx context.Context, entity Entity, from, to IState) error {
+			records = append(records, name)
+			return nil
+		}
+	}
+	express := false
+	isExpress := func(ctx context.Context, entity Entity, from, to IState) bool { return express }
+
+	sm := NewMachine("TestStateMachine_Completion")
+	sm.Trans(sm.State("created").Exit("pay", ""), sm.State("checking").Entry("check", record("check")))
+	sm.Trans(sm.State("checking").Exit(Completion, "express", isExpress), sm.State("shipping").Entry("ship", record("ship")))
+	sm.Trans(sm.State("checking").Exit(Completion, ""), sm.State("reviewing").Entry("review", record("review")))
+	sm.Trans(sm.State("shipping").Exit(Completion, ""), sm.State("shipped").Entry("done", record("done")))
+	sm.Show()
+
+	entity := NewMutableTestEntity("1", sm.State("created"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("reviewing")
+	goassert.That(t, records).Equal([]string{"check", "review"})
+
+	records, express = nil, true
+	entity = NewMutableTestEntity("2", sm.State("created"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("shipped")
+	goassert.That(t, records).Equal([]string{"check", "ship", "done"})
+
+	events, err := sm.AvailableEvents(context.Background(), NewMutableTestEntity("3", sm.State("checking")))
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, len(events)).Equal(0)
+}
+
+func TestStateMachine_CompletionLoop(t *testing.T) {
+	sm := NewMachine("TestStateMachine_CompletionLoop", CompletionLimit(3))
+	sm.Trans(sm.State("s1").Exit("e1", ""), sm.State("s2").Entry(""))
+	sm.Trans(sm.State("s2").Exit(Completion, ""), sm.State("s3").Entry(""))
+	sm.Trans(sm.State("s3").Exit(Completion, ""), sm.State("s2").Entry(""))
+
+	entity := NewMutableTestEntity("1", sm.State("s1"))
+	err := sm.Trigger(context.Background(), entity, "e1")
+	goassert.That(t, errors.Is(err, ErrCompletionLoop)).Equal(true)
+	// 已经执行的转换保留
+	goassert.That(t, entity.s.ID()).Equal("s3")
+}
+
+func TestStateMachine_CompletionInternal(t *testing.T) {
+	count := 0
+	sm := NewMachine("TestStateMachine_CompletionInternal", Machines(nil))
+	sm.Trans(sm.State("s1").Exit("e1", ""), sm.State("s2").Entry(""))
+	sm.Internal(sm.State("s2").Exit(Completion, ""), "count", func(ctx context.Context, entity Entity, from, to IState) error {
+		count++
+		return nil
+	})
+
+	entity := NewMutableTestEntity("1", sm.State("s1"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e1")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("s2")
+	goassert.That(t, count).Equal(1)
+}
+
+func TestStateMachine_CompletionFailed(t *testing.T) {
+	cause := errors.New("fail")
+	sm := NewMachine("TestStateMachine_CompletionFailed")
+	sm.Trans(sm.State("s1").Exit("e1", ""), sm.State("s2").Entry(""))
+	sm.Trans(sm.State("s2").Exit(Completion, ""), sm.State("s3").Entry("fail", func(ctx context.Context, entity Entity, from, to IState) error {
+		return cause
+	}))
+
+	entity := NewMutableTestEntity("1", sm.State("s1"))
+	err := sm.Trigger(context.Background(), entity, "e1")
+	goassert.That(t, errors.Is(err, ErrActionFailed)).Equal(true)
+	goassert.That(t, errors.Is(err, cause)).Equal(true)
+	goassert.That(t, entity.s.ID()).Equal("s2")
+}
+
+func TestBuilder_DSLCompletion(t *testing.T) {
+	registry := NewRegistry(nil).RegisterCondition("passed", func(ctx context.Context, entity Entity, from, to IState) bool {
+		return true
+	})
+	builder := NewBuilder().Registry(registry)
+	err := builder.DSL(`
+s1 -> s2 : e1
+s2 -> s3 [passed]
+s3 -> [*]`)
+	goassert.That(t, err).Equal(nil)
+	sm := builder.Build("TestBuilder_DSLCompletion")
+
+	entity := NewMutableTestEntity("1", State("s1"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e1")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("[*]")
+
+	data, err := Marshal(sm, JSON)
+	goassert.That(t, err).Equal(nil)
+	builder = NewBuilder().Registry(registry).Machines(NewMachineRegistry())
+	goassert.That(t, builder.Load(data, JSON)).Equal(nil)
+	loaded, err := builder.TryBuild("TestBuilder_DSLCompletion_loaded")
+	goassert.That(t, err).Equal(nil)
+	again, err := NewDefinition(loaded)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, again.Transitions[1].Event).Equal("")
+	goassert.That(t, again.Transitions[1].Guard).Equal("passed")
+
+	entity = NewMutableTestEntity("2", State("s1"))
+	goassert.That(t, loaded.Trigger(context.Background(), entity, "e1")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("[*]")
+}
@@ -0,0 +1,205 @@
+package gosm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Configuration fork 以后实体所处的状态（状态向量），记录每个区域的当前状态，没有进入的区域为 nil。
+// 区域的状态也可以是 Configuration（区域中再次 fork）。
+// Trigger 把事件分发到每个区域并更新对应区域的状态，实现 MutableEntity 的实体会通过 SetState 得到新的 Configuration
+type Configuration struct {
+	fork    *comboStateEntry
+	regions []IState
+}
+
+func (o *Configuration) ID() interface{} {
+	var regions []string
+	for _, region := range o.regions {
+		if region != nil {
+			regions = append(regions, fmt.Sprint(region.ID()))
+		}
+	}
+	return fmt.Sprintf("%v(%s)", o.fork.fork.ID(), strings.Join(regions, "|"))
+}
+
+func (o *Configuration) String() string {
+	return fmt.Sprint(o.ID())
+}
+
+func (o *Configuration) Entry(desc string, actions ...Action) StateEntry {
+	return &normalStateEntry{state: o, actions: actions, desc: desc}
+}
+
+func (o *Configuration) Exit(event Event, desc string, condition ...Condition) *StateExit {
+	return o.fork.fork.Exit(event, desc, condition...)
+}
+
+func (o *Configuration) Bind(_ *StateMachine) {
+}
+
+func (o *Configuration) Machine() *StateMachine {
+	return o.fork.machine
+}
+
+// Fork 产生这个 Configuration 的 fork 伪状态
+func (o *Configuration) Fork() IState {
+	return o.fork.fork
+}
+
+// Regions 每个区域的当前状态，按照 fork 分支的顺序排列，没有进入的区域为 nil
+func (o *Configuration) Regions() []IState {
+	return append([]IState(nil), o.regions...)
+}
+
+// Leaves 所有活动的叶子状态，嵌套的 Configuration 会被展开
+func (o *Configuration) Leaves() []IState {
+	var leaves []IState
+	for _, region := range o.regions {
+		switch r := region.(type) {
+		case nil:
+		case *Configuration:
+			leaves = append(leaves, r.Leaves()...)
+		default:
+			leaves = append(leaves, r)
+		}
+	}
+	return leaves
+}
+
+// IsIn 是否处于状态 s：s 为 Configuration 本身、它的 fork 伪状态或者任意一个活动的（嵌套）区域状态
+func (o *Configuration) IsIn(s IState) bool {
+	if s.ID() == o.ID() || s.ID() == o.fork.fork.ID() {
+		return true
+	}
+	for _, region := range o.regions {
+		if region != nil && IsIn(region, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Configuration) copy() *Configuration {
+	return &Configuration{fork: o.fork, regions: append([]IState(nil), o.regions...)}
+}
+
+// IsIn 实体的当前状态 current 是否处于状态 s，current 可以是普通状态或者 Configuration
+func IsIn(current, s IState) bool {
+	if c, ok := current.(*Configuration); ok {
+		return c.IsIn(s)
+	}
+	return current.ID() == s.ID()
+}
+
+// FormatState 把实体状态转换成可以存储的文本，使用 StateMachine.ParseState 还原。
+// 普通状态为 ID；Configuration 为 fork(区域1|区域2|...)，没有进入的区域为空。
+// 状态 ID 中不能包含 ( ) |
+func FormatState(s IState) string {
+	c, ok := s.(*Configuration)
+	if !ok {
+		return fmt.Sprint(s.ID())
+	}
+	regions := make([]string, len(c.regions))
+	for i, region := range c.regions {
+		if region != nil {
+			regions[i] = FormatState(region)
+		}
+	}
+	return fmt.Sprintf("%v(%s)", c.fork.fork.ID(), strings.Join(regions, "|"))
+}
+
+// ParseState 还原 FormatState 的结果，状态从状态机以及它链接的子状态机中查找，
+// 找不到时返回 ErrUnknownState
+func (o *StateMachine) ParseState(text string) (IState, error) {
+	i := strings.Index(text, "(")
+	if i < 0 {
+		if s := o.findState(text); s != nil {
+			return s, nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrUnknownState, text)
+	}
+	if !strings.HasSuffix(text, ")") {
+		return nil, fmt.Errorf("状态格式错误: %s", text)
+	}
+
+	combo := o.findFork(text[:i])
+	if combo == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownState, text[:i])
+	}
+	parts, err := splitRegions(text[i+1 : len(text)-1])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, text)
+	}
+	if len(parts) != len(combo.stateEntries) {
+		return nil, fmt.Errorf("状态格式错误: %s 需要 %d 个区域", text, len(combo.stateEntries))
+	}
+
+	c := &Configuration{fork: combo, regions: make([]IState, len(parts))}
+	for j, part := range parts {
+		if part == "" {
+			continue
+		}
+		region := machineOf(combo.stateEntries[j].State(), combo.machine)
+		if c.regions[j], err = region.ParseState(part); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// findState 按照 ID 的文本查找状态，不包括伪状态
+func (o *StateMachine) findState(text string) IState {
+	for _, sm := range append([]*StateMachine{o}, o.Submachines()...) {
+		states := sm.States()
+		if end, has := sm.states["[*]"]; has {
+			states = append(states, end)
+		}
+		for _, s := range states {
+			if fmt.Sprint(s.ID()) == text {
+				if s.Machine() == nil {
+					return sm.State(s.ID())
+				}
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+func (o *StateMachine) findFork(text string) *comboStateEntry {
+	for _, sm := range append([]*StateMachine{o}, o.Submachines()...) {
+		for _, linker := range sm.linkers {
+			if combo, ok := linker.entry.(*comboStateEntry); ok && fmt.Sprint(combo.fork.ID()) == text {
+				return combo
+			}
+		}
+	}
+	return nil
+}
+
+// splitRegions 按照最外层的 | 拆分区域
+func splitRegions(text string) ([]string, error) {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range text {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("状态格式错误")
+			}
+		case '|':
+			if depth == 0 {
+				parts = append(parts, text[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("状态格式错误")
+	}
+	return append(parts, text[start:]), nil
+}
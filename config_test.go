@@ -0,0 +1,86 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"testing"
+)
+
+func configMachine() *StateMachine {
+	sm := NewMachine("TestConfiguration", Machines(nil))
+	sm.Fork(State("created").Exit("pay", "")).
+		Link(Serial(All), State("pending").Entry(""), State("packing").Entry(""))
+	sm.Fork(State("packing").Exit("split", "")).
+		Link(Serial(All), State("box").Entry(""), State("label").Entry(""))
+	sm.Trans(State("pending").Exit("confirm", ""), State("done").Entry(""))
+	sm.Trans(State("box").Exit("seal", ""), State("sealed").Entry(""))
+	return sm
+}
+
+func TestConfiguration(t *testing.T) {
+	sm := configMachine()
+	entity := NewMutableTestEntity("1", State("created"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "split")).Equal(nil)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "seal")).Equal(nil)
+
+	config := entity.s.(*Configuration)
+	goassert.That(t, config.Fork().ID()).Equal("created_pay_fork")
+	goassert.That(t, len(config.Regions())).Equal(2)
+	goassert.That(t, ids(config.Leaves())).Equal([]interface{}{"pending", "sealed", "label"})
+
+	tests := []struct {
+		state IState
+		in    bool
+	}{
+		{State("pending"), true},
+		{State("sealed"), true},
+		{State("packing_split_fork"), true},
+		{State("created_pay_fork"), true},
+		{config, true},
+		{State("packing"), false},
+		{State("box"), false},
+	}
+	for _, tt := range tests {
+		goassert.That(t, IsIn(entity.s, tt.state)).Equal(tt.in)
+	}
+	goassert.That(t, IsIn(State("created"), State("created"))).Equal(true)
+	goassert.That(t, IsIn(State("created"), State("pending"))).Equal(false)
+}
+
+func TestStateMachine_ParseState(t *testing.T) {
+	sm := configMachine()
+	entity := NewMutableTestEntity("1", State("created"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "split")).Equal(nil)
+
+	text := FormatState(entity.s)
+	goassert.That(t, text).Equal("created_pay_fork(pending|packing_split_fork(box|label))")
+
+	parsed, err := sm.ParseState(text)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, FormatState(parsed)).Equal(text)
+
+	restored := NewMutableTestEntity("1", parsed)
+	goassert.That(t, sm.Trigger(context.Background(), restored, "seal")).Equal(nil)
+	goassert.That(t, FormatState(restored.s)).Equal("created_pay_fork(pending|packing_split_fork(sealed|label))")
+
+	parsed, err = sm.ParseState("created_pay_fork(|packing)")
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, parsed.(*Configuration).Regions()[0] == nil).Equal(true)
+	goassert.That(t, FormatState(parsed)).Equal("created_pay_fork(|packing)")
+
+	parsed, err = sm.ParseState("done")
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, parsed.ID()).Equal("done")
+
+	for _, text := range []string{"nope", "nope_fork(a|b)", "created_pay_fork(pending|nope)"} {
+		_, err = sm.ParseState(text)
+		goassert.That(t, errors.Is(err, ErrUnknownState)).Equal(true)
+	}
+	for _, text := range []string{"created_pay_fork(pending)", "created_pay_fork(pending|packing", "created_pay_fork(pending|packing))"} {
+		_, err = sm.ParseState(text)
+		goassert.That(t, err).NotEqual(nil)
+	}
+}
@@ -0,0 +1,147 @@
+package gosm
+
+import (
+	"context"
+	"log"
+)
+
+// DefaultDeferLimit 每个实体默认最多保存的延迟事件数量
+const DefaultDeferLimit = 16
+
+// DeferLimit 每个实体最多保存的延迟事件数量，队列已满时 Trigger 返回 ErrDeferQueueFull
+func DeferLimit(n int) Option {
+	return func(machine *StateMachine) {
+		machine.deferLimit = n
+	}
+}
+
+// OnDeferredError 重新分发的延迟事件执行失败时调用，失败的事件被丢弃。
+// 失败不影响触发重新分发的 Trigger 的结果，默认打印日志
+func OnDeferredError(handler func(entityID string, event Event, err error)) Option {
+	return func(machine *StateMachine) {
+		machine.deferredError = handler
+	}
+}
+
+// Defer 实体处于 s（或者它的子状态、并发区域）时，没有转换处理的 events 保存到实体的延迟队列中，Trigger 返回 nil。
+// 实体进入新的状态以后按照保存的顺序重新分发：新状态处理的事件立即执行，仍然可以延迟的事件继续保存，其它事件丢弃
+func (o *StateMachine) Defer(s IState, events ...Event) {
+	s.Bind(o)
+	if o.deferrals == nil {
+		o.deferrals = make(map[interface{}][]Event)
+	}
+	o.deferrals[s.ID()] = append(o.deferrals[s.ID()], events...)
+}
+
+// Deferrable 状态 s 声明的延迟事件
+func (o *StateMachine) Deferrable(s IState) []Event {
+	return append([]Event(nil), o.deferrals[s.ID()]...)
+}
+
+// Deferred 实体延迟队列中的事件，按照保存的顺序排列
+func (o *StateMachine) Deferred(entityID string) []Event {
+	o.deferLock.Lock()
+	defer o.deferLock.Unlock()
+	return append([]Event(nil), o.deferred[entityID]...)
+}
+
+// deferrable 实体处于 state 时是否延迟事件，包括外层组合状态和所有并发区域声明的事件
+func (o *StateMachine) deferrable(state IState, event Event) bool {
+	for _, l := range activeLevels(state, o) {
+		for _, e := range l.machine.deferrals[l.state.ID()] {
+			if e == event {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handles 实体处于 state 时是否有处理事件的转换
+func (o *StateMachine) handles(state IState, event Event) bool {
+	for _, e := range o.acceptable(state) {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// postpone 事件加入实体的延迟队列
+func (o *StateMachine) postpone(entity Entity, state IState, event Event) error {
+	o.deferLock.Lock()
+	defer o.deferLock.Unlock()
+	if len(o.deferred[entity.ID()]) >= o.deferLimit {
+		return &TriggerError{Kind: ErrDeferQueueFull, EntityID: entity.ID(), State: state, Event: event}
+	}
+	if o.deferred == nil {
+		o.deferred = make(map[string][]Event)
+	}
+	o.deferred[entity.ID()] = append(o.deferred[entity.ID()], event)
+	return nil
+}
+
+// next 取出实体进入 state 以后第一个可以处理的延迟事件，丢弃既不能处理也不能延迟的事件
+func (o *StateMachine) next(entity Entity, state IState) (Event, bool) {
+	o.deferLock.Lock()
+	defer o.deferLock.Unlock()
+	events := o.deferred[entity.ID()]
+	var kept []Event
+	for i, event := range events {
+		switch {
+		case o.handles(state, event):
+			kept = append(kept, events[i+1:]...)
+			o.keep(entity.ID(), kept)
+			return event, true
+		case o.deferrable(state, event):
+			kept = append(kept, event)
+		default:
+			log.Printf("[%s] 状态 %v 不处理延迟事件 %v，丢弃", entity.ID(), state, event)
+		}
+	}
+	o.keep(entity.ID(), kept)
+	return nil, false
+}
+
+// requeue 没有执行的事件放回队列的最前面
+func (o *StateMachine) requeue(entity Entity, event Event) {
+	o.deferLock.Lock()
+	defer o.deferLock.Unlock()
+	o.keep(entity.ID(), append([]Event{event}, o.deferred[entity.ID()]...))
+}
+
+func (o *StateMachine) keep(entityID string, events []Event) {
+	if len(events) == 0 {
+		delete(o.deferred, entityID)
+		return
+	}
+	o.deferred[entityID] = events
+}
+
+// redispatch 实体进入新的状态以后分发延迟的事件，直到没有可以处理的事件。
+// 执行失败的事件交给 OnDeferredError 以后丢弃，继续分发剩余的事件；ctx 结束时事件放回队列
+func (o *StateMachine) redispatch(c context.Context, entity Entity, state IState) {
+	for {
+		event, ok := o.next(entity, state)
+		if !ok {
+			return
+		}
+		if cancelled(c, entity, state, event) != nil {
+			o.requeue(entity, event)
+			return
+		}
+		_, next, err := o.dispatch(c, entity, state, event)
+		if err != nil {
+			o.deferredFailed(entity.ID(), event, err)
+		}
+		state = next
+	}
+}
+
+func (o *StateMachine) deferredFailed(entityID string, event Event, err error) {
+	if o.deferredError != nil {
+		o.deferredError(entityID, event, err)
+		return
+	}
+	log.Printf("[%s] 延迟事件 %v 执行失败，丢弃: %v", entityID, event, err)
+}
@@ -0,0 +1,108 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"strings"
+	"testing"
+)
+
+func TestStateMachine_Defer(t *testing.T) {
+	var records []string
+	sm := joinMachine("TestStateMachine_Defer", 0, nil)
+	sm.Defer(State("pending"), "address_changed")
+	sm.Defer(State("shipped"), "address_changed", "remark")
+	sm.Internal(State("completed").Exit("address_changed", ""), "", func(ctx context.Context, entity Entity, from, to IState) error {
+		records = append(records, "address_changed")
+		return nil
+	})
+	goassert.That(t, sm.Deferrable(State("shipped"))).Equal([]Event{"address_changed", "remark"})
+
+	entity := NewMutableTestEntity("1", State("created"))
+	err := sm.Trigger(context.Background(), entity, "address_changed")
+	goassert.That(t, errors.Is(err, ErrUnknownEvent)).Equal(true)
+
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "address_changed")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("created_pay_fork(pending|packing)")
+	goassert.That(t, sm.Deferred("1")).Equal([]Event{"address_changed"})
+	err = sm.Trigger(context.Background(), entity, "close")
+	goassert.That(t, errors.Is(err, ErrUnknownEvent)).Equal(true)
+
+	// 新状态仍然延迟事件
+	goassert.That(t, sm.Trigger(context.Background(), entity, "ship")).Equal(nil)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "remark")).Equal(nil)
+	goassert.That(t, sm.Deferred("1")).Equal([]Event{"address_changed", "remark"})
+	goassert.That(t, len(records)).Equal(0)
+
+	// 汇合以后处理 address_changed，completed 不处理也不延迟的 remark 丢弃
+	goassert.That(t, sm.Trigger(context.Background(), entity, "confirm")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("completed")
+	goassert.That(t, records).Equal([]string{"address_changed"})
+	goassert.That(t, len(sm.Deferred("1"))).Equal(0)
+
+	_, text := sm.Graph(map[*StateMachine]bool{})
+	goassert.That(t, strings.Contains(text, "shipped : remark / defer")).Equal(true)
+}
+
+func TestStateMachine_DeferLimit(t *testing.T) {
+	failed := errors.New("failed")
+	var dropped []error
+	sm := NewMachine("TestStateMachine_DeferLimit", Machines(nil), DeferLimit(2), OnDeferredError(func(entityID string, event Event, err error) {
+		dropped = append(dropped, err)
+	}))
+	sm.Trans(State("s1").Exit("e1", ""), State("s2").Entry(""))
+	sm.Trans(State("s2").Exit("e2", ""), State("s3").Entry("", func(ctx context.Context, entity Entity, from, to IState) error {
+		return failed
+	}))
+	sm.Trans(State("s2").Exit("e3", "never", func(ctx context.Context, entity Entity, from, to IState) bool {
+		return false
+	}), State("s3").Entry(""))
+	sm.Defer(State("s1"), "e2", "e3")
+
+	entity := NewMutableTestEntity("1", State("s1"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e3")).Equal(nil)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e2")).Equal(nil)
+	err := sm.Trigger(context.Background(), entity, "e2")
+	goassert.That(t, errors.Is(err, ErrDeferQueueFull)).Equal(true)
+	goassert.That(t, sm.Deferred("1")).Equal([]Event{"e3", "e2"})
+
+	// e3 条件检查失败、e2 动作失败，都交给 OnDeferredError 以后丢弃，e1 的结果不受影响
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e1")).Equal(nil)
+	goassert.That(t, len(dropped)).Equal(2)
+	goassert.That(t, errors.Is(dropped[0], ErrNoGuardPassed)).Equal(true)
+	goassert.That(t, errors.Is(dropped[1], ErrActionFailed)).Equal(true)
+	var triggerErr *TriggerError
+	goassert.That(t, errors.As(dropped[1], &triggerErr)).Equal(true)
+	goassert.That(t, triggerErr.Event).Equal("e2")
+	goassert.That(t, entity.s.ID()).Equal("s2")
+	goassert.That(t, len(sm.Deferred("1"))).Equal(0)
+}
+
+func TestBuilder_DSLDefer(t *testing.T) {
+	builder := NewBuilder()
+	err := builder.DSL(`
+state s2 defer e3, e4
+s1 -> s2 : e1
+s2 -> s3 : e2
+s3 -> s4 : e3`)
+	goassert.That(t, err).Equal(nil)
+	sm := builder.Build("TestBuilder_DSLDefer", Machines(nil))
+
+	entity := NewMutableTestEntity("1", State("s1"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e1")).Equal(nil)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e3")).Equal(nil)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e2")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("s4")
+
+	def, err := NewDefinition(sm)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, def.States[1].Defer).Equal([]string{"e3", "e4"})
+
+	data, err := Marshal(sm, YAML)
+	goassert.That(t, err).Equal(nil)
+	loaded, err := Unmarshal(data, YAML, Machines(nil))
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, loaded.Deferrable(State("s2"))).Equal([]Event{"e3", "e4"})
+}
@@ -0,0 +1,353 @@
+package gosm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Definition 可序列化的状态机定义。
+// 状态、事件统一使用字符串表示；guard、action、fork 执行器使用 Registry 中注册的名字；
+// 同一个 from、event 的多条转换按顺序组成 choice；machine 表示目标状态属于另外一个状态机（子状态机）
+type Definition struct {
+	Name        string           `json:"name" yaml:"name"`
+	States      []*StateDef      `json:"states,omitempty" yaml:"states,omitempty"`
+	Transitions []*TransitionDef `json:"transitions" yaml:"transitions"`
+}
+
+// StateDef Defer 为状态延迟的事件
+type StateDef struct {
+	ID         string   `json:"id" yaml:"id"`
+	Stereotype string   `json:"stereotype,omitempty" yaml:"stereotype,omitempty"`
+	Defer      []string `json:"defer,omitempty" yaml:"defer,omitempty"`
+}
+
+// TransitionDef To 为 [*] 时转换到结束状态，为 [H]、[H*] 时进入 Machine 的浅、深历史入口；
+// Event 为空时为完成转换；Internal 为内部转换，To 和 From 相同
+type TransitionDef struct {
+	From    string   `json:"from" yaml:"from"`
+	Event   string   `json:"event,omitempty" yaml:"event,omitempty"`
+	Guard   string   `json:"guard,omitempty" yaml:"guard,omitempty"`
+	To      string   `json:"to,omitempty" yaml:"to,omitempty"`
+	Machine string   `json:"machine,omitempty" yaml:"machine,omitempty"`
+	Action  string   `json:"action,omitempty" yaml:"action,omitempty"`
+	Fork    *ForkDef `json:"fork,omitempty" yaml:"fork,omitempty"`
+
+	Internal bool `json:"internal,omitempty" yaml:"internal,omitempty"`
+}
+
+type ForkDef struct {
+	Executor string       `json:"executor" yaml:"executor"`
+	Branches []*BranchDef `json:"branches" yaml:"branches"`
+	Join     *JoinDef     `json:"join,omitempty" yaml:"join,omitempty"`
+}
+
+// JoinDef 区域的当前状态属于 finals 时区域完成，完成的区域数量达到 quorum（0 表示全部）时转换到 to
+type JoinDef struct {
+	Desc    string   `json:"desc,omitempty" yaml:"desc,omitempty"`
+	Finals  []string `json:"finals" yaml:"finals"`
+	Quorum  int      `json:"quorum,omitempty" yaml:"quorum,omitempty"`
+	To      string   `json:"to" yaml:"to"`
+	Machine string   `json:"machine,omitempty" yaml:"machine,omitempty"`
+	Action  string   `json:"action,omitempty" yaml:"action,omitempty"`
+}
+
+type BranchDef struct {
+	To      string `json:"to" yaml:"to"`
+	Machine string `json:"machine,omitempty" yaml:"machine,omitempty"`
+	Action  string `json:"action,omitempty" yaml:"action,omitempty"`
+}
+
+type Format string
+
+const (
+	JSON Format = "json"
+	YAML Format = "yaml"
+)
+
+func (o Format) marshal(v interface{}) ([]byte, error) {
+	switch o {
+	case JSON:
+		return json.MarshalIndent(v, "", "  ")
+	case YAML:
+		return yaml.Marshal(v)
+	}
+	return nil, fmt.Errorf("不支持的格式 %s", o)
+}
+
+func (o Format) unmarshal(data []byte, v interface{}) error {
+	switch o {
+	case JSON:
+		return json.Unmarshal(data, v)
+	case YAML:
+		return yaml.UnmarshalStrict(data, v)
+	}
+	return fmt.Errorf("不支持的格式 %s", o)
+}
+
+// Marshal 把状态机序列化为定义文本。
+// guard、action 的名字取自 Exit、Entry 的 desc，fork 执行器的名字取自 ForkStateExit.Desc
+func Marshal(sm *StateMachine, format Format) ([]byte, error) {
+	def, err := NewDefinition(sm)
+	if err != nil {
+		return nil, err
+	}
+	return format.marshal(def)
+}
+
+// Unmarshal 从定义文本创建状态机，名字从 DefaultRegistry 解析，子状态机从 DefaultMachines 查找
+func Unmarshal(data []byte, format Format, options ...Option) (*StateMachine, error) {
+	def := &Definition{}
+	if err := format.unmarshal(data, def); err != nil {
+		return nil, err
+	}
+	builder := NewBuilder()
+	if err := builder.Definition(def); err != nil {
+		return nil, err
+	}
+	return builder.TryBuild(def.Name, options...)
+}
+
+// Load 解析定义文本并加入到 Builder 的转换列表中
+func (o *Builder) Load(data []byte, format Format) error {
+	def := &Definition{}
+	if err := format.unmarshal(data, def); err != nil {
+		return err
+	}
+	return o.Definition(def)
+}
+
+// Definition 把定义加入到 Builder 的转换列表中。引用的名字没有注册时返回 *UnknownNamesError
+func (o *Builder) Definition(def *Definition) error {
+	for _, s := range def.States {
+		if s.ID == "" {
+			return errors.New("状态 id 不能为空")
+		}
+		o.state(s.ID).stereotype = s.Stereotype
+		o.deferEvents(s.ID, s.Defer)
+	}
+
+	resolver := &nameResolver{registry: o.getRegistry(), machines: o.getMachines()}
+	var transitions []*transCfg
+	for i, t := range def.Transitions {
+		if t.From == "" {
+			return fmt.Errorf("transitions[%d]: from 不能为空", i)
+		}
+		if (t.To == "") == (t.Fork == nil) {
+			return fmt.Errorf("transitions[%d]: to、fork 必须并且只能设置一个", i)
+		}
+
+		cfg := &transCfg{builder: o, from: []*state{o.state(t.From)}, event: eventOf(t.Event), actionDesc: t.Action}
+		cfg.condition, cfg.condDesc = resolver.condition(t.Guard, dslPos{})
+		cfg.action = resolver.action(t.Action, dslPos{})
+
+		switch {
+		case t.Internal:
+			if t.To != t.From {
+				return fmt.Errorf("transitions[%d]: 内部转换的 to 必须和 from 相同", i)
+			}
+			cfg.internal = true
+		case t.Fork != nil:
+			if len(t.Fork.Branches) == 0 {
+				return fmt.Errorf("transitions[%d]: fork 至少需要一个分支", i)
+			}
+			var names []string
+			for _, name := range strings.Split(t.Fork.Executor, ",") {
+				names = append(names, strings.TrimSpace(name))
+			}
+			cfg.fork = &forkCfg{executor: resolver.executor(names, dslPos{}), desc: t.Fork.Executor}
+			for _, b := range t.Fork.Branches {
+				cfg.fork.branches = append(cfg.fork.branches, &transCfg{
+					builder:    o,
+					to:         o.state(b.To),
+					link:       resolver.machine(b.Machine),
+					action:     resolver.action(b.Action, dslPos{}),
+					actionDesc: b.Action,
+				})
+			}
+			if j := t.Fork.Join; j != nil {
+				if j.To == "" {
+					return fmt.Errorf("transitions[%d]: join 的 to 不能为空", i)
+				}
+				cfg.fork.join = &joinCfg{desc: j.Desc, quorum: j.Quorum, target: &transCfg{
+					builder:    o,
+					to:         o.state(j.To),
+					link:       resolver.machine(j.Machine),
+					action:     resolver.action(j.Action, dslPos{}),
+					actionDesc: j.Action,
+				}}
+				for _, f := range j.Finals {
+					cfg.fork.join.finals = append(cfg.fork.join.finals, o.state(f))
+				}
+			}
+		case t.To == "[*]":
+			cfg.end = true
+		case t.To == "[H]" || t.To == "[H*]":
+			if t.Machine == "" {
+				return fmt.Errorf("transitions[%d]: 历史入口 %s 需要设置 machine", i, t.To)
+			}
+			cfg.history = t.To
+			cfg.link = resolver.machine(t.Machine)
+		default:
+			cfg.to = o.state(t.To)
+			cfg.link = resolver.machine(t.Machine)
+		}
+		transitions = append(transitions, cfg)
+	}
+	if err := resolver.err(); err != nil {
+		return err
+	}
+	o.transitions = append(o.transitions, transitions...)
+	return nil
+}
+
+// NewDefinition 导出状态机的定义，转换按照定义的顺序排列。
+// 没有名字的 guard、action、定时转换以及组合状态无法从定义中还原，返回错误
+func NewDefinition(sm *StateMachine) (*Definition, error) {
+	if len(sm.children) > 0 {
+		return nil, fmt.Errorf("状态机 %s: 组合状态（Compose）不能导出", sm.Name)
+	}
+	def := &Definition{Name: sm.Name}
+	states := make(map[string]*StateDef)
+	addState := func(s IState) {
+		id := fmt.Sprint(s.ID())
+		if _, has := states[id]; has || id == "[*]" || isPseudoState(s) {
+			return
+		}
+		sd := &StateDef{ID: id}
+		if ss, ok := s.(*state); ok {
+			sd.Stereotype = ss.stereotype
+		}
+		for _, event := range sm.deferrals[s.ID()] {
+			sd.Defer = append(sd.Defer, fmt.Sprint(event))
+		}
+		states[id] = sd
+	}
+	linked := func(s IState) string {
+		if s.Machine() != nil && s.Machine() != sm {
+			return s.Machine().Name
+		}
+		addState(s)
+		return ""
+	}
+
+	for _, s := range sm.states {
+		addState(s)
+	}
+
+	for _, linker := range sm.linkers {
+		exit := linker.exit
+		t := &TransitionDef{From: fmt.Sprint(exit.state.ID()), Event: fmt.Sprint(exit.event)}
+		if _, timeout := exit.event.(TimeoutEvent); timeout {
+			return nil, fmt.Errorf("%s: 定时转换（After、At）不能导出", linker.Text())
+		}
+		if exit.desc == "" {
+			return nil, fmt.Errorf("%s: guard 没有名字，请使用 Exit 的 desc 设置", linker.Text())
+		}
+		if exit.desc != "Any" {
+			t.Guard = exit.desc
+		}
+		action := func(entry StateEntry) (string, error) {
+			name, ok := actionName(entry)
+			if !ok {
+				return "", fmt.Errorf("%s: action 没有名字，请使用 Entry 的 desc 设置", linker.Text())
+			}
+			return name, nil
+		}
+
+		switch entry := linker.entry.(type) {
+		case *comboStateEntry:
+			if entry.desc == "" {
+				return nil, fmt.Errorf("%s: fork 执行器没有名字，请使用 ForkStateExit.Desc 设置", linker.Text())
+			}
+			t.Fork = &ForkDef{Executor: entry.desc}
+			for _, e := range entry.stateEntries {
+				name, err := action(e)
+				if err != nil {
+					return nil, err
+				}
+				t.Fork.Branches = append(t.Fork.Branches, &BranchDef{
+					To:      fmt.Sprint(e.State().ID()),
+					Machine: linked(e.State()),
+					Action:  name,
+				})
+			}
+			if j := entry.join; j != nil && j.entry != nil {
+				name, err := action(j.entry)
+				if err != nil {
+					return nil, err
+				}
+				t.Fork.Join = &JoinDef{
+					Desc:    j.desc,
+					Quorum:  j.quorum,
+					To:      fmt.Sprint(j.entry.State().ID()),
+					Machine: linked(j.entry.State()),
+					Action:  name,
+				}
+				for _, f := range j.finals {
+					t.Fork.Join.Finals = append(t.Fork.Join.Finals, fmt.Sprint(f.ID()))
+				}
+			}
+		case *internalStateEntry:
+			t.To = t.From
+			t.Internal = true
+		case *historyStateEntry:
+			t.To = fmt.Sprint(entry.state.ID())
+			t.Machine = entry.machine.Name
+		default:
+			t.To = fmt.Sprint(entry.State().ID())
+			t.Machine = linked(entry.State())
+		}
+		if t.Fork == nil {
+			name, err := action(linker.entry)
+			if err != nil {
+				return nil, err
+			}
+			t.Action = name
+		}
+		def.Transitions = append(def.Transitions, t)
+	}
+
+	for _, s := range states {
+		def.States = append(def.States, s)
+	}
+	sort.Slice(def.States, func(i, j int) bool {
+		return def.States[i].ID < def.States[j].ID
+	})
+	return def, nil
+}
+
+// actionName 入口 action 的名字。有 action 却没有名字时返回 false，
+// Builder 对没有名字的 action 使用 Noop，StateExit.End 的名字固定为 end
+func actionName(entry StateEntry) (string, bool) {
+	var e *normalStateEntry
+	switch entry := entry.(type) {
+	case *normalStateEntry:
+		e = entry
+	case *internalStateEntry:
+		e = &entry.normalStateEntry
+	case *historyStateEntry:
+		e = &entry.normalStateEntry
+	default:
+		return entry.Desc(), true
+	}
+	desc := e.desc
+	if desc == "end" && e.state.ID() == "[*]" {
+		desc = ""
+	}
+	if desc != "" {
+		return desc, true
+	}
+	noop := reflect.ValueOf(Noop).Pointer()
+	for _, action := range e.actions {
+		if reflect.ValueOf(action).Pointer() != noop {
+			return "", false
+		}
+	}
+	return "", true
+}
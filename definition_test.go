@@ -0,0 +1,187 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"testing"
+	"time"
+)
+
+const subDefinition = `
+name: TestDefinition_sub
+transitions:
+- from: checking
+  event: pass
+  to: '[*]'
+`
+
+const mainDefinition = `name: TestDefinition_main
+states:
+- id: created
+- id: paid
+  stereotype: important
+- id: shipping
+transitions:
+- from: created
+  event: pay
+  guard: TestDefinition.inStock
+  to: paid
+  action: TestDefinition.move
+- from: paid
+  event: ship
+  guard: TestDefinition.express
+  to: shipping
+  action: TestDefinition.move
+- from: paid
+  event: ship
+  to: checking
+  machine: TestDefinition_sub
+  action: TestDefinition.move
+- from: paid
+  event: split
+  fork:
+    executor: parallel,all
+    branches:
+    - to: shipping
+    - to: checking
+      machine: TestDefinition_sub
+- from: shipping
+  event: finish
+  to: '[*]'
+  action: TestDefinition.move
+`
+
+func init() {
+	RegisterCondition("TestDefinition.inStock", Any)
+	RegisterCondition("TestDefinition.express", func(ctx context.Context, entity Entity, from, to IState) bool {
+		return false
+	})
+	RegisterAction("TestDefinition.move", func(ctx context.Context, entity Entity, from, to IState) error {
+		entity.(*TestEntity).s = to
+		return nil
+	})
+}
+
+func TestUnmarshal(t *testing.T) {
+	sub, err := Unmarshal([]byte(subDefinition), YAML)
+	goassert.That(t, err).Equal(nil)
+	sm, err := Unmarshal([]byte(mainDefinition), YAML)
+	goassert.That(t, err).Equal(nil)
+	sm.Show()
+
+	entity := NewTestEntity("1", State("created"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("paid")
+	goassert.That(t, sm.Trigger(context.Background(), entity, "ship")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("checking")
+	goassert.That(t, entity.s.Machine()).Equal(sub)
+	goassert.That(t, sub.Trigger(context.Background(), entity, "pass")).Equal(nil)
+
+	data, err := Marshal(sm, YAML)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, string(data)).Equal(mainDefinition)
+}
+
+func TestMarshal_JSON(t *testing.T) {
+	builder := NewBuilder()
+	err := builder.DSL(`
+state s1 <<start>>
+s1 -> s2 : e1 [TestDefinition.inStock] / TestDefinition.move
+s2 : e2 choice {
+    [TestDefinition.express] -> s3
+    [else] -> [*] / TestDefinition.move
+}
+s2 : e3 fork(serial, oneFast) {
+    -> s3 / TestDefinition.move
+    -> s4
+}`)
+	goassert.That(t, err).Equal(nil)
+	sm := builder.Build("TestMarshal_JSON")
+
+	data, err := Marshal(sm, JSON)
+	goassert.That(t, err).Equal(nil)
+
+	loaded, err := Unmarshal(data, JSON, Machines(NewMachineRegistry()))
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, loaded.Name).Equal("TestMarshal_JSON")
+
+	again, err := Marshal(loaded, JSON)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, string(again)).Equal(string(data))
+}
+
+func TestMarshal_UnnamedFork(t *testing.T) {
+	sm := NewMachine("TestMarshal_UnnamedFork")
+	sm.Fork(State("s1").Exit("e1", "")).Link(Serial(All), State("s2").Entry(""))
+	sm.Trans(State("s1").Exit("e1", ""), State("s2").Entry(""))
+	_, err := Marshal(sm, JSON)
+	goassert.That(t, err).NotEqual(nil)
+}
+
+func TestMarshal_Unnamed(t *testing.T) {
+	move := func(ctx context.Context, entity Entity, from, to IState) error { return nil }
+	inStock := func(ctx context.Context, entity Entity, from, to IState) bool { return true }
+
+	sm := NewMachine("TestMarshal_UnnamedGuard", Machines(nil))
+	sm.Trans(State("s1").Exit("e1", "", inStock), State("s2").Entry("move", move))
+	_, err := Marshal(sm, JSON)
+	goassert.That(t, err).NotEqual(nil)
+
+	sm = NewMachine("TestMarshal_UnnamedAction", Machines(nil))
+	sm.Trans(State("s1").Exit("e1", "inStock", inStock), State("s2").Entry("", move))
+	_, err = Marshal(sm, JSON)
+	goassert.That(t, err).NotEqual(nil)
+
+	sm = NewMachine("TestMarshal_UnnamedEnd", Machines(nil))
+	sm.Exit(State("s1"), "e1", "").End(move)
+	_, err = Marshal(sm, JSON)
+	goassert.That(t, err).NotEqual(nil)
+
+	sm = NewMachine("TestMarshal_Timer", Machines(nil))
+	sm.After(sm.State("s1"), 30*time.Minute, "").Link(sm.State("s2").Entry(""))
+	_, err = Marshal(sm, JSON)
+	goassert.That(t, err).NotEqual(nil)
+
+	sm = NewMachine("TestMarshal_Compose", Machines(nil))
+	sm.Trans(sm.State("s1").Exit("e1", ""), sm.State("s2").Entry(""))
+	sub := NewMachine("TestMarshal_Compose_sub", Machines(nil))
+	sub.Trans(sub.State("x1").Exit("e2", ""), sub.State("x2").Entry(""))
+	sm.Compose(sm.State("s2"), sub)
+	_, err = Marshal(sm, JSON)
+	goassert.That(t, err).NotEqual(nil)
+
+	sm = NewMachine("TestMarshal_Noop", Machines(nil))
+	sm.Trans(State("s1").Exit("e1", ""), State("s2").Entry("", Noop))
+	sm.Exit(State("s2"), "e2", "").End()
+	_, err = Marshal(sm, JSON)
+	goassert.That(t, err).Equal(nil)
+}
+
+func TestUnmarshal_Error(t *testing.T) {
+	_, err := Unmarshal([]byte(`{"name": "x", "transitions": [{"from": "s1", "event": "e1"}]}`), JSON)
+	goassert.That(t, err).NotEqual(nil)
+
+	_, err = Unmarshal([]byte(`{"name": "x", "transitions": [
+		{"from": "s1", "event": "e1", "to": "s2", "guard": "nope", "machine": "nope"}]}`), JSON)
+	var unknown *UnknownNamesError
+	goassert.That(t, errors.As(err, &unknown)).Equal(true)
+	goassert.That(t, unknown.Names).Equal([]UnknownName{
+		{Kind: KindCondition, Name: "nope"},
+		{Kind: KindMachine, Name: "nope"},
+	})
+
+	_, err = Unmarshal([]byte(`{"name": "x", "transitions": [
+		{"from": "s1", "event": "e1", "fork": {"executor": "parallel,all,x", "branches": [{"to": "s2"}]}}]}`), JSON)
+	goassert.That(t, err).NotEqual(nil)
+	goassert.That(t, errors.As(err, &unknown)).Equal(false)
+
+	_, err = Unmarshal([]byte("name: x\nunknown: 1"), YAML)
+	goassert.That(t, err).NotEqual(nil)
+
+	_, err = Unmarshal([]byte(`{"name": "TestUnmarshal_Error", "transitions": []}`), JSON)
+	goassert.That(t, err).Equal(nil)
+	_, err = Unmarshal([]byte(`{"name": "TestUnmarshal_Error", "transitions": []}`), JSON)
+	var duplicate *ErrDuplicateMachine
+	goassert.That(t, errors.As(err, &duplicate)).Equal(true)
+}
@@ -0,0 +1,187 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoMailbox Post 的 ctx 不是 Dispatcher 执行动作时的 ctx
+	ErrNoMailbox = errors.New("不在 Dispatcher 中执行，不能 Post")
+	// ErrMailboxFull 实体邮箱中等待的事件达到 Dispatcher.MailboxLimit
+	ErrMailboxFull = errors.New("邮箱已满")
+)
+
+// DefaultMailboxLimit 每个实体邮箱默认最多等待的事件数量
+const DefaultMailboxLimit = 1024
+
+// Dispatcher 每个实体一个邮箱，同一个实体的事件按照顺序逐个执行到完成（run-to-completion），
+// 不同实体的事件并发执行。动作中使用 Post 发送的后续事件放入邮箱，当前事件执行完成以后再执行，
+// 不会在持有 LockerFactory 锁的时候递归调用 Trigger
+type Dispatcher struct {
+	machine   *StateMachine
+	lock      sync.Mutex
+	mailboxes map[string]*mailbox
+	// OnError Post 的事件执行失败时调用，默认打印日志
+	OnError func(entityID string, event Event, err error)
+	// MailboxLimit 每个实体邮箱最多等待的事件数量，超过时 Send、Post 返回 ErrMailboxFull，0 表示不限制
+	MailboxLimit int
+}
+
+type mailbox struct {
+	messages []*message
+}
+
+type message struct {
+	ctx     context.Context
+	entity  Entity
+	event   Event
+	receipt *Receipt
+}
+
+type mailboxCtx struct{}
+
+// posting 动作的 ctx 中保存的当前事件
+type posting struct {
+	dispatcher *Dispatcher
+	message    *message
+}
+
+func NewDispatcher(machine *StateMachine) *Dispatcher {
+	return &Dispatcher{
+		machine:   machine,
+		mailboxes: make(map[string]*mailbox),
+		OnError: func(entityID string, event Event, err error) {
+			log.Printf("[%s] 事件 %v 执行失败: %v", entityID, event, err)
+		},
+		MailboxLimit: DefaultMailboxLimit,
+	}
+}
+
+// Send 事件放入实体的邮箱，立即返回。不需要结果时可以忽略 Receipt，邮箱已满时 Receipt 的错误为 ErrMailboxFull
+func (o *Dispatcher) Send(ctx context.Context, entity Entity, event Event) *Receipt {
+	receipt := &Receipt{done: make(chan struct{})}
+	if err := o.enqueue(&message{ctx: ctx, entity: entity, event: event, receipt: receipt}); err != nil {
+		receipt.err = err
+		close(receipt.done)
+	}
+	return receipt
+}
+
+// Pending 实体邮箱中等待执行的事件数量，不包括正在执行的事件
+func (o *Dispatcher) Pending(entityID string) int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if box := o.mailboxes[entityID]; box != nil {
+		return len(box.messages)
+	}
+	return 0
+}
+
+// Post 在 Dispatcher 执行的动作中发送后续事件，事件放入当前实体的邮箱，结果交给 Dispatcher.OnError。
+// ctx 为动作的 ctx，后续事件使用 ctx 中的值，但是不随当前事件的 ctx 取消或者超时。
+// 不在 Dispatcher 中执行时返回 ErrNoMailbox，邮箱已满时返回 ErrMailboxFull
+func Post(ctx context.Context, event Event) error {
+	p, ok := ctx.Value(mailboxCtx{}).(*posting)
+	if !ok {
+		return ErrNoMailbox
+	}
+	return p.dispatcher.enqueue(&message{ctx: detached{p.message.ctx}, entity: p.message.entity, event: event})
+}
+
+func (o *Dispatcher) enqueue(m *message) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	id := m.entity.ID()
+	box, running := o.mailboxes[id]
+	if !running {
+		box = &mailbox{}
+		o.mailboxes[id] = box
+	}
+	if o.MailboxLimit > 0 && len(box.messages) >= o.MailboxLimit {
+		return ErrMailboxFull
+	}
+	box.messages = append(box.messages, m)
+	if !running {
+		go o.run(id, box)
+	}
+	return nil
+}
+
+// run 逐个执行邮箱中的事件，邮箱为空时退出
+func (o *Dispatcher) run(id string, box *mailbox) {
+	for {
+		o.lock.Lock()
+		if len(box.messages) == 0 {
+			delete(o.mailboxes, id)
+			o.lock.Unlock()
+			return
+		}
+		m := box.messages[0]
+		box.messages = box.messages[1:]
+		o.lock.Unlock()
+
+		err := o.machine.Trigger(context.WithValue(m.ctx, mailboxCtx{}, &posting{o, m}), m.entity, m.event)
+		if m.receipt != nil {
+			m.receipt.err = err
+			close(m.receipt.done)
+		} else if err != nil {
+			o.OnError(id, m.event, err)
+		}
+	}
+}
+
+// Receipt Send 的事件的执行结果
+type Receipt struct {
+	done chan struct{}
+	err  error
+}
+
+// Done 事件执行完成以后关闭
+func (o *Receipt) Done() <-chan struct{} {
+	return o.done
+}
+
+// Err 事件执行的结果，Done 关闭以前为 nil
+func (o *Receipt) Err() error {
+	select {
+	case <-o.done:
+		return o.err
+	default:
+		return nil
+	}
+}
+
+// Wait 等待事件执行完成并返回 Trigger 的结果，ctx 结束时返回 ctx.Err()，事件仍然会执行
+func (o *Receipt) Wait(ctx context.Context) error {
+	select {
+	case <-o.done:
+		return o.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// detached 保留 parent 中的值，不继承 parent 的取消和截止时间
+type detached struct {
+	parent context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detached) Done() <-chan struct{} {
+	return nil
+}
+
+func (detached) Err() error {
+	return nil
+}
+
+func (o detached) Value(key interface{}) interface{} {
+	return o.parent.Value(key)
+}
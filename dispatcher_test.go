@@ -0,0 +1,148 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/threeq/goassert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mutexLocker 不可重入的 LockerFactory
+type mutexLocker struct {
+	lock  sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (o *mutexLocker) New(id string) sync.Locker {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.locks == nil {
+		o.locks = make(map[string]*sync.Mutex)
+	}
+	if _, has := o.locks[id]; !has {
+		o.locks[id] = &sync.Mutex{}
+	}
+	return o.locks[id]
+}
+
+func TestDispatcher_Post(t *testing.T) {
+	var lock sync.Mutex
+	var records []string
+	record := func(name string) Action {
+		return func(ctx context.Context, entity Entity, from, to IState) error {
+			lock.Lock()
+			defer lock.Unlock()
+			records = append(records, name)
+			return nil
+		}
+	}
+	sm := NewMachine("TestDispatcher_Post", Machines(nil), Locker(&mutexLocker{}))
+	sm.Trans(sm.State("created").Exit("pay", ""), sm.State("paid").Entry("", record("pay"), func(ctx context.Context, entity Entity, from, to IState) error {
+		// 在持有锁的时候发送后续事件
+		return Post(ctx, "ship")
+	}, record("paid")))
+	sm.Trans(sm.State("paid").Exit("ship", ""), sm.State("shipped").Entry("", record("ship"), func(ctx context.Context, entity Entity, from, to IState) error {
+		return Post(ctx, "unknown")
+	}))
+	sm.Trans(sm.State("shipped").Exit("close", ""), sm.State("closed").Entry("", record("close")))
+
+	dispatcher := NewDispatcher(sm)
+	errs := make(chan error, 1)
+	dispatcher.OnError = func(entityID string, event Event, err error) {
+		errs <- err
+	}
+
+	entity := NewMutableTestEntity("1", sm.State("created"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	goassert.That(t, dispatcher.Send(ctx, entity, "pay").Wait(ctx)).Equal(nil)
+	goassert.That(t, errors.Is(<-errs, ErrUnknownEvent)).Equal(true)
+
+	receipt := dispatcher.Send(ctx, entity, "close")
+	goassert.That(t, receipt.Wait(ctx)).Equal(nil)
+	goassert.That(t, receipt.Err()).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("closed")
+	goassert.That(t, records).Equal([]string{"pay", "paid", "ship", "close"})
+
+	receipt = dispatcher.Send(ctx, entity, "pay")
+	<-receipt.Done()
+	goassert.That(t, errors.Is(receipt.Err(), ErrUnknownState)).Equal(true)
+
+	goassert.That(t, Post(ctx, "ship")).Equal(ErrNoMailbox)
+}
+
+func TestDispatcher_Order(t *testing.T) {
+	var lock sync.Mutex
+	counts := make(map[string]int)
+	sm := NewMachine("TestDispatcher_Order", Machines(nil))
+	sm.Trans(sm.State("s").Exit("inc", ""), sm.State("s").Entry("", func(ctx context.Context, entity Entity, from, to IState) error {
+		lock.Lock()
+		defer lock.Unlock()
+		counts[entity.ID()]++
+		return nil
+	}))
+	dispatcher := NewDispatcher(sm)
+
+	var receipts []*Receipt
+	for i := 0; i < 100; i++ {
+		entity := NewMutableTestEntity(fmt.Sprint(i%4), sm.State("s"))
+		receipts = append(receipts, dispatcher.Send(context.Background(), entity, "inc"))
+	}
+	for _, receipt := range receipts {
+		goassert.That(t, receipt.Wait(context.Background())).Equal(nil)
+	}
+	goassert.That(t, counts).Equal(map[string]int{"0": 25, "1": 25, "2": 25, "3": 25})
+	goassert.That(t, dispatcher.Pending("0")).Equal(0)
+}
+
+type dispatcherKey struct{}
+
+func TestDispatcher_PostDetached(t *testing.T) {
+	values := make(chan interface{}, 1)
+	sm := NewMachine("TestDispatcher_PostDetached", Machines(nil))
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), dispatcherKey{}, "trace"))
+	sm.Trans(sm.State("created").Exit("pay", ""), sm.State("paid").Entry("", func(c context.Context, entity Entity, from, to IState) error {
+		err := Post(c, "ship")
+		// 后续事件不随当前事件的 ctx 取消
+		cancel()
+		return err
+	}))
+	sm.Trans(sm.State("paid").Exit("ship", ""), sm.State("shipped").Entry("", func(c context.Context, entity Entity, from, to IState) error {
+		values <- c.Value(dispatcherKey{})
+		return nil
+	}))
+
+	dispatcher := NewDispatcher(sm)
+	dispatcher.OnError = func(entityID string, event Event, err error) {
+		values <- err
+	}
+	entity := NewMutableTestEntity("1", sm.State("created"))
+	goassert.That(t, dispatcher.Send(ctx, entity, "pay").Wait(context.Background())).Equal(nil)
+	goassert.That(t, <-values).Equal("trace")
+}
+
+func TestDispatcher_MailboxLimit(t *testing.T) {
+	release := make(chan struct{})
+	sm := NewMachine("TestDispatcher_MailboxLimit", Machines(nil))
+	sm.Trans(sm.State("s").Exit("wait", ""), sm.State("s").Entry("", func(ctx context.Context, entity Entity, from, to IState) error {
+		<-release
+		return nil
+	}))
+	dispatcher := NewDispatcher(sm)
+	dispatcher.MailboxLimit = 1
+
+	entity := NewMutableTestEntity("1", sm.State("s"))
+	first := dispatcher.Send(context.Background(), entity, "wait")
+	for dispatcher.Pending("1") > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := dispatcher.Send(context.Background(), entity, "wait")
+	goassert.That(t, dispatcher.Send(context.Background(), entity, "wait").Err()).Equal(ErrMailboxFull)
+
+	close(release)
+	goassert.That(t, first.Wait(context.Background())).Equal(nil)
+	goassert.That(t, second.Wait(context.Background())).Equal(nil)
+}
@@ -1,3 +1,585 @@
 package gosm
 
+import (
+	"fmt"
+	"unicode"
+)
 
+// DSL 语法（按行书写，`#`、`//` 为注释，`;` 等同于换行）：
+//
+//      state paid <<stereotype>>                    状态声明（可选）
+//      state packing defer address_changed, remark   状态延迟的事件
+//      created, paid -> cancelled : cancel [guard] / action
+//      paid -> [*] : finish / archive                结束状态
+//      checking -> approved [passed]                 没有事件的完成转换
+//      paid : remind [guard] / notify                内部转换，不离开状态
+//      paid : ship choice {                          条件选择，按顺序检查
+//          [inStock] -> shipping / reserve
+//          [else] -> backorder
+//      }
+//      paid : split [guard] fork(parallel, all) {    并行分支
+//          -> shipping / ship
+//          -> invoicing / invoice
+//      }
+//
+// 标识符可以是字母、数字、`_`、`.`、`-` 组成的单词，或者双引号括起来的字符串。
+// guard、action、fork 执行器通过名字引用，由 Builder 的 Registry 解析。
+
+// DSLError DSL 解析错误，带有出错的行列位置
+type DSLError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (o *DSLError) Error() string {
+	return fmt.Sprintf("dsl:%d:%d: %s", o.Line, o.Column, o.Msg)
+}
+
+type dslPos struct {
+	line int
+	col  int
+}
+
+func (o dslPos) errorf(format string, args ...interface{}) *DSLError {
+	return &DSLError{Line: o.line, Column: o.col, Msg: fmt.Sprintf(format, args...)}
+}
+
+type dslName struct {
+	pos   dslPos
+	value string
+}
+
+type dslState struct {
+	pos        dslPos
+	id         string
+	stereotype string
+	deferrals  []string
+}
+
+type dslTrans struct {
+	pos      dslPos
+	from     []string
+	to       string
+	event    string
+	guard    dslName
+	action   dslName
+	executor []dslName
+	branches []*dslTrans
+	internal bool
+}
+
+type dslFile struct {
+	states []*dslState
+	trans  []*dslTrans
+}
+
+//---------------------------------------------------------------------------------
+// 词法分析
+
+type dslTokenKind int
+
+const (
+	tokEOF dslTokenKind = iota
+	tokNewline
+	tokIdent
+	tokArrow
+	tokColon
+	tokComma
+	tokSlash
+	tokLBrack
+	tokRBrack
+	tokLBrace
+	tokRBrace
+	tokLParen
+	tokRParen
+	tokLShift
+	tokRShift
+	tokEnd
+)
+
+var dslTokenNames = map[dslTokenKind]string{
+	tokEOF:     "文件结束",
+	tokNewline: "换行",
+	tokIdent:   "标识符",
+	tokArrow:   "'->'",
+	tokColon:   "':'",
+	tokComma:   "','",
+	tokSlash:   "'/'",
+	tokLBrack:  "'['",
+	tokRBrack:  "']'",
+	tokLBrace:  "'{'",
+	tokRBrace:  "'}'",
+	tokLParen:  "'('",
+	tokRParen:  "')'",
+	tokLShift:  "'<<'",
+	tokRShift:  "'>>'",
+	tokEnd:     "'[*]'",
+}
+
+type dslToken struct {
+	kind  dslTokenKind
+	value string
+	pos   dslPos
+}
+
+func (o dslToken) String() string {
+	if o.kind == tokIdent {
+		return fmt.Sprintf("'%s'", o.value)
+	}
+	return dslTokenNames[o.kind]
+}
+
+func isDSLIdent(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-'
+}
+
+func lexDSL(src string) ([]dslToken, error) {
+	var tokens []dslToken
+	runes := []rune(src)
+	line, col := 1, 1
+	i := 0
+
+	advance := func(n int) {
+		for k := 0; k < n; k++ {
+			if runes[i] == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
+			i++
+		}
+	}
+	// peek 当前位置是否以 s 开头，s 只包含 ASCII 字符
+	peek := func(s string) bool {
+		if i+len(s) > len(runes) {
+			return false
+		}
+		for k := 0; k < len(s); k++ {
+			if runes[i+k] != rune(s[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	emit := func(kind dslTokenKind, value string, n int) {
+		tokens = append(tokens, dslToken{kind: kind, value: value, pos: dslPos{line, col}})
+		advance(n)
+	}
+
+	for i < len(runes) {
+		r := runes[i]
+		switch {
+		case r == '\n' || r == ';':
+			emit(tokNewline, "", 1)
+		case unicode.IsSpace(r):
+			advance(1)
+		case r == '#' || peek("//"):
+			for i < len(runes) && runes[i] != '\n' {
+				advance(1)
+			}
+		case peek("->"):
+			emit(tokArrow, "", 2)
+		case peek("[*]"):
+			emit(tokEnd, "[*]", 3)
+		case peek("<<"):
+			emit(tokLShift, "", 2)
+		case peek(">>"):
+			emit(tokRShift, "", 2)
+		case r == ':':
+			emit(tokColon, "", 1)
+		case r == ',':
+			emit(tokComma, "", 1)
+		case r == '/':
+			emit(tokSlash, "", 1)
+		case r == '[':
+			emit(tokLBrack, "", 1)
+		case r == ']':
+			emit(tokRBrack, "", 1)
+		case r == '{':
+			emit(tokLBrace, "", 1)
+		case r == '}':
+			emit(tokRBrace, "", 1)
+		case r == '(':
+			emit(tokLParen, "", 1)
+		case r == ')':
+			emit(tokRParen, "", 1)
+		case r == '"':
+			pos := dslPos{line, col}
+			advance(1)
+			start := i
+			for i < len(runes) && runes[i] != '"' && runes[i] != '\n' {
+				advance(1)
+			}
+			if i >= len(runes) || runes[i] != '"' {
+				return nil, pos.errorf("字符串没有结束")
+			}
+			tokens = append(tokens, dslToken{kind: tokIdent, value: string(runes[start:i]), pos: pos})
+			advance(1)
+		case isDSLIdent(r):
+			pos := dslPos{line, col}
+			start := i
+			for i < len(runes) && isDSLIdent(runes[i]) && !peek("->") {
+				advance(1)
+			}
+			tokens = append(tokens, dslToken{kind: tokIdent, value: string(runes[start:i]), pos: pos})
+		default:
+			return nil, dslPos{line, col}.errorf("非法字符 %q", r)
+		}
+	}
+	tokens = append(tokens, dslToken{kind: tokEOF, pos: dslPos{line, col}})
+	return tokens, nil
+}
+
+//---------------------------------------------------------------------------------
+// 语法分析
+
+type dslParser struct {
+	tokens []dslToken
+	cur    int
+}
+
+func parseDSL(src string) (*dslFile, error) {
+	tokens, err := lexDSL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &dslParser{tokens: tokens}
+	file := &dslFile{}
+	for {
+		p.skipNewlines()
+		if p.peek().kind == tokEOF {
+			return file, nil
+		}
+		if err := p.parseStmt(file); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (o *dslParser) peek() dslToken {
+	return o.tokens[o.cur]
+}
+
+func (o *dslParser) next() dslToken {
+	t := o.tokens[o.cur]
+	if t.kind != tokEOF {
+		o.cur++
+	}
+	return t
+}
+
+func (o *dslParser) accept(kind dslTokenKind) bool {
+	if o.peek().kind == kind {
+		o.next()
+		return true
+	}
+	return false
+}
+
+func (o *dslParser) expect(kind dslTokenKind) (dslToken, error) {
+	t := o.next()
+	if t.kind != kind {
+		return t, t.pos.errorf("期望 %s，实际为 %s", dslTokenNames[kind], t)
+	}
+	return t, nil
+}
+
+func (o *dslParser) isKeyword(keyword string) bool {
+	t := o.peek()
+	return t.kind == tokIdent && t.value == keyword
+}
+
+func (o *dslParser) skipNewlines() {
+	for o.accept(tokNewline) {
+	}
+}
+
+func (o *dslParser) endOfStmt() error {
+	t := o.peek()
+	if t.kind == tokEOF {
+		return nil
+	}
+	if t.kind != tokNewline {
+		return t.pos.errorf("期望换行，实际为 %s", t)
+	}
+	o.next()
+	return nil
+}
+
+func (o *dslParser) parseStmt(file *dslFile) error {
+	if o.isKeyword("state") && o.tokens[o.cur+1].kind == tokIdent {
+		s, err := o.parseState()
+		if err != nil {
+			return err
+		}
+		file.states = append(file.states, s)
+		return o.endOfStmt()
+	}
+
+	pos := o.peek().pos
+	var from []string
+	for {
+		t, err := o.expect(tokIdent)
+		if err != nil {
+			return err
+		}
+		from = append(from, t.value)
+		if !o.accept(tokComma) {
+			break
+		}
+	}
+
+	switch t := o.next(); t.kind {
+	case tokArrow:
+		trans, err := o.parseSimple(pos, from)
+		if err != nil {
+			return err
+		}
+		file.trans = append(file.trans, trans)
+	case tokColon:
+		trans, err := o.parseBlock(pos, from)
+		if err != nil {
+			return err
+		}
+		file.trans = append(file.trans, trans...)
+	default:
+		return t.pos.errorf("期望 '->' 或 ':'，实际为 %s", t)
+	}
+	return o.endOfStmt()
+}
+
+// state ID [<<stereotype>>] [defer event, ...]
+func (o *dslParser) parseState() (*dslState, error) {
+	pos := o.next().pos
+	id, err := o.expect(tokIdent)
+	if err != nil {
+		return nil, err
+	}
+	s := &dslState{pos: pos, id: id.value}
+	if o.accept(tokLShift) {
+		stereotype, err := o.expect(tokIdent)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := o.expect(tokRShift); err != nil {
+			return nil, err
+		}
+		s.stereotype = stereotype.value
+	}
+	if o.isKeyword("defer") {
+		o.next()
+		for {
+			event, err := o.expect(tokIdent)
+			if err != nil {
+				return nil, err
+			}
+			s.deferrals = append(s.deferrals, event.value)
+			if !o.accept(tokComma) {
+				break
+			}
+		}
+	}
+	return s, nil
+}
+
+// from -> to [: event] [guard] / action，没有事件时为完成转换
+func (o *dslParser) parseSimple(pos dslPos, from []string) (*dslTrans, error) {
+	to, err := o.parseTarget()
+	if err != nil {
+		return nil, err
+	}
+	trans := &dslTrans{pos: pos, from: from, to: to}
+	if o.accept(tokColon) {
+		event, err := o.expect(tokIdent)
+		if err != nil {
+			return nil, err
+		}
+		trans.event = event.value
+	}
+	if trans.guard, err = o.parseGuard(); err != nil {
+		return nil, err
+	}
+	if trans.action, err = o.parseAction(); err != nil {
+		return nil, err
+	}
+	return trans, nil
+}
+
+// from : event choice { ... }、from : event [guard] fork(...) { ... } 或者内部转换 from : event [guard] / action
+func (o *dslParser) parseBlock(pos dslPos, from []string) ([]*dslTrans, error) {
+	event, err := o.expect(tokIdent)
+	if err != nil {
+		return nil, err
+	}
+	guard, err := o.parseGuard()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := o.peek(); {
+	case t.kind == tokSlash || t.kind == tokNewline || t.kind == tokEOF:
+		trans := &dslTrans{pos: pos, from: from, event: event.value, guard: guard, internal: true}
+		if trans.action, err = o.parseAction(); err != nil {
+			return nil, err
+		}
+		return []*dslTrans{trans}, nil
+	case o.isKeyword("choice"):
+		if guard.value != "" {
+			return nil, guard.pos.errorf("choice 不支持 guard，请在分支中声明")
+		}
+		o.next()
+		return o.parseChoice(pos, from, event.value)
+	case o.isKeyword("fork"):
+		o.next()
+		trans, err := o.parseFork(pos, from, event.value)
+		if err != nil {
+			return nil, err
+		}
+		trans.guard = guard
+		return []*dslTrans{trans}, nil
+	default:
+		return nil, t.pos.errorf("期望 'choice'、'fork' 或 '/'，实际为 %s", t)
+	}
+}
+
+func (o *dslParser) parseChoice(pos dslPos, from []string, event string) ([]*dslTrans, error) {
+	var trans []*dslTrans
+	err := o.parseBranches(func() error {
+		t := o.peek()
+		if t.kind != tokLBrack {
+			return t.pos.errorf("choice 分支需要 guard，实际为 %s", t)
+		}
+		guard, err := o.parseGuard()
+		if err != nil {
+			return err
+		}
+		if _, err := o.expect(tokArrow); err != nil {
+			return err
+		}
+		to, err := o.parseTarget()
+		if err != nil {
+			return err
+		}
+		action, err := o.parseAction()
+		if err != nil {
+			return err
+		}
+		trans = append(trans, &dslTrans{
+			pos: t.pos, from: from, to: to, event: event, guard: guard, action: action,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(trans) == 0 {
+		return nil, pos.errorf("choice 至少需要一个分支")
+	}
+	return trans, nil
+}
+
+func (o *dslParser) parseFork(pos dslPos, from []string, event string) (*dslTrans, error) {
+	trans := &dslTrans{pos: pos, from: from, event: event}
+	if _, err := o.expect(tokLParen); err != nil {
+		return nil, err
+	}
+	for {
+		t, err := o.expect(tokIdent)
+		if err != nil {
+			return nil, err
+		}
+		trans.executor = append(trans.executor, dslName{pos: t.pos, value: t.value})
+		if !o.accept(tokComma) {
+			break
+		}
+	}
+	if _, err := o.expect(tokRParen); err != nil {
+		return nil, err
+	}
+	if len(trans.executor) > 2 {
+		return nil, trans.executor[2].pos.errorf("fork 最多两个参数")
+	}
+
+	err := o.parseBranches(func() error {
+		arrow, err := o.expect(tokArrow)
+		if err != nil {
+			return err
+		}
+		to, err := o.expect(tokIdent)
+		if err != nil {
+			return err
+		}
+		action, err := o.parseAction()
+		if err != nil {
+			return err
+		}
+		trans.branches = append(trans.branches, &dslTrans{pos: arrow.pos, to: to.value, action: action})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(trans.branches) == 0 {
+		return nil, pos.errorf("fork 至少需要一个分支")
+	}
+	return trans, nil
+}
+
+// { branch NEWLINE ... }
+func (o *dslParser) parseBranches(branch func() error) error {
+	if _, err := o.expect(tokLBrace); err != nil {
+		return err
+	}
+	for {
+		o.skipNewlines()
+		if o.accept(tokRBrace) {
+			return nil
+		}
+		if o.peek().kind == tokEOF {
+			return o.peek().pos.errorf("期望 '}'，实际为文件结束")
+		}
+		if err := branch(); err != nil {
+			return err
+		}
+		if o.peek().kind != tokRBrace {
+			if err := o.endOfStmt(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (o *dslParser) parseTarget() (string, error) {
+	if o.accept(tokEnd) {
+		return "[*]", nil
+	}
+	t, err := o.expect(tokIdent)
+	return t.value, err
+}
+
+func (o *dslParser) parseGuard() (dslName, error) {
+	if !o.accept(tokLBrack) {
+		return dslName{}, nil
+	}
+	t, err := o.expect(tokIdent)
+	if err != nil {
+		return dslName{}, err
+	}
+	if _, err := o.expect(tokRBrack); err != nil {
+		return dslName{}, err
+	}
+	return dslName{pos: t.pos, value: t.value}, nil
+}
+
+func (o *dslParser) parseAction() (dslName, error) {
+	if !o.accept(tokSlash) {
+		return dslName{}, nil
+	}
+	t, err := o.expect(tokIdent)
+	if err != nil {
+		return dslName{}, err
+	}
+	return dslName{pos: t.pos, value: t.value}, nil
+}
@@ -1,13 +1,93 @@
 package gosm
 
 import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
 	"testing"
 )
 
-func TestDSLParse(t *testing.T) {
-	//compiler, err := Parse(dslRaw)
-	//err := compiler(funcs)
-	//goassert.That(t, err).Equal(nil)
-	//machine := GetMachine("s1")
-	//goassert.That(t, err).NotEqual(nil)
+const orderDSL = `
+# 订单流程
+state paid <<important>>
+
+created -> paid : pay [inStock] / moveTo
+created, paid -> cancelled : cancel / moveTo
+paid : ship choice {
+    [express] -> shipping / moveTo
+    [else] -> backorder / moveTo
+}
+paid : split fork(parallel, all) {
+    -> invoicing / notify
+    -> "packing list"
+}
+cancelled -> [*] : archive
+`
+
+func dslBuilder() *Builder {
+	moveTo := func(ctx context.Context, entity Entity, from, to IState) error {
+		entity.(*TestEntity).s = to
+		return nil
+	}
+	return NewBuilder().
+		Condition("inStock", Any).
+		Condition("express", func(ctx context.Context, entity Entity, from, to IState) bool { return false }).
+		Action("moveTo", moveTo).
+		Action("notify", Noop)
+}
+
+func TestBuilder_DSL(t *testing.T) {
+	builder := dslBuilder()
+	err := builder.DSL(orderDSL)
+	goassert.That(t, err).Equal(nil)
+
+	sm := builder.Build("TestBuilder_DSL")
+	sm.Show()
+
+	entity := NewTestEntity("1", State("created"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("paid")
+
+	goassert.That(t, sm.Trigger(context.Background(), entity, "ship")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("backorder")
+
+	entity2 := NewMutableTestEntity("2", State("paid"))
+	goassert.That(t, sm.Trigger(context.Background(), entity2, "split")).Equal(nil)
+	goassert.That(t, entity2.s.ID()).Equal("paid_split_fork(invoicing|packing list)")
+
+	entity = NewTestEntity("3", State("paid"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "cancel")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("cancelled")
+	goassert.That(t, sm.Trigger(context.Background(), entity, "archive")).Equal(nil)
+
+	s, ok := sm.states["paid"].(*state)
+	goassert.That(t, ok).Equal(true)
+	goassert.That(t, s.stereotype).Equal("important")
+}
+
+func TestBuilder_DSLError(t *testing.T) {
+	tests := []struct {
+		name   string
+		dsl    string
+		line   int
+		column int
+	}{
+		{"missing event", "s1 -> s2 :", 1, 11},
+		{"missing arrow", "s1 s2 : e1", 1, 4},
+		{"bad char", "s1 -> s2 : e1 !", 1, 15},
+		{"empty choice", "s1 : e1 choice {\n}", 1, 1},
+		{"unclosed block", "s1 : e1 choice {\n [else] -> s2", 2, 14},
+		{"duplicate state", "state s1\nstate s1 <<x>>", 2, 1},
+		{"unclosed string", `s1 -> "s2 : e1`, 1, 7},
+		{"extra fork argument", "s1 : e1 fork(parallel, all, x) {\n -> s2\n}", 1, 29},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := dslBuilder().DSL(tt.dsl)
+			var dslErr *DSLError
+			goassert.That(t, errors.As(err, &dslErr)).Equal(true)
+			goassert.That(t, dslErr.Line).Equal(tt.line)
+			goassert.That(t, dslErr.Column).Equal(tt.column)
+		})
+	}
 }
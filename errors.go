@@ -0,0 +1,52 @@
+package gosm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Trigger 返回的错误类型，使用 errors.Is 判断
+var (
+	ErrUnknownState  = errors.New("状态没有定义")
+	ErrUnknownEvent  = errors.New("事件没有定义")
+	ErrNoGuardPassed = errors.New("所有事件检查均失败")
+	ErrActionFailed  = errors.New("动作执行失败")
+	ErrCommitFailed  = errors.New("状态提交失败")
+	// ErrCompletionLoop 连续执行的完成转换超过 CompletionLimit，之前的转换已经提交
+	ErrCompletionLoop = errors.New("完成转换次数超过限制")
+	// ErrDeferQueueFull 实体的延迟事件数量达到 DeferLimit
+	ErrDeferQueueFull = errors.New("延迟事件队列已满")
+	// ErrCancelled ctx 结束（取消或者超时），Cause 为 ctx.Err() 或者动作返回的错误
+	ErrCancelled = errors.New("执行被取消")
+)
+
+// TriggerError Trigger 失败的详细信息，使用 errors.As 获取。
+// Kind 为上面的错误类型之一；Rejected 为条件检查失败的转换；Cause 为动作、After、持久化返回的错误
+type TriggerError struct {
+	Kind     error
+	EntityID string
+	State    IState
+	Event    Event
+	Rejected []*Transition
+	Cause    error
+}
+
+func (o *TriggerError) Error() string {
+	var state interface{}
+	if o.State != nil {
+		state = o.State.ID()
+	}
+	msg := fmt.Sprintf("[%s] %v - %v: %s", o.EntityID, state, o.Event, o.Kind)
+	if o.Cause != nil {
+		msg += ": " + o.Cause.Error()
+	}
+	return msg
+}
+
+func (o *TriggerError) Is(target error) bool {
+	return o.Kind == target
+}
+
+func (o *TriggerError) Unwrap() error {
+	return o.Cause
+}
@@ -0,0 +1,55 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"testing"
+)
+
+func TestTriggerError(t *testing.T) {
+	never := func(ctx context.Context, entity Entity, from, to IState) bool { return false }
+	failed := errors.New("failed")
+
+	sm := NewMachine("TestTriggerError", Machines(nil))
+	sm.Trans(State("s1").Exit("e1", "never", never), State("s2").Entry(""))
+	sm.Trans(State("s1").Exit("e1", "never2", never), State("s3").Entry(""))
+	sm.Trans(State("s1").Exit("e2", "Any"), State("s2").Entry("fail", func(ctx context.Context, entity Entity, from, to IState) error {
+		return failed
+	}))
+
+	tests := []struct {
+		name  string
+		state IState
+		event Event
+		kind  error
+	}{
+		{"unknown state", State("s0"), "e1", ErrUnknownState},
+		{"unknown event", State("s1"), "e0", ErrUnknownEvent},
+		{"no guard passed", State("s1"), "e1", ErrNoGuardPassed},
+		{"action failed", State("s1"), "e2", ErrActionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sm.Trigger(context.Background(), NewMutableTestEntity("1", tt.state), tt.event)
+			goassert.That(t, errors.Is(err, tt.kind)).Equal(true)
+
+			var triggerErr *TriggerError
+			goassert.That(t, errors.As(err, &triggerErr)).Equal(true)
+			goassert.That(t, triggerErr.EntityID).Equal("1")
+			goassert.That(t, triggerErr.State.ID()).Equal(tt.state.ID())
+			goassert.That(t, triggerErr.Event).Equal(tt.event)
+		})
+	}
+
+	err := sm.Trigger(context.Background(), NewMutableTestEntity("1", State("s1")), "e1")
+	var triggerErr *TriggerError
+	errors.As(err, &triggerErr)
+	goassert.That(t, len(triggerErr.Rejected)).Equal(2)
+	goassert.That(t, triggerErr.Rejected[0].CondDesc).Equal("never")
+	goassert.That(t, triggerErr.Rejected[1].To.ID()).Equal("s3")
+
+	err = sm.Trigger(context.Background(), NewMutableTestEntity("1", State("s1")), "e2")
+	goassert.That(t, errors.Is(err, failed)).Equal(true)
+	goassert.That(t, errors.Is(err, ErrUnknownEvent)).Equal(false)
+}
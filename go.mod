@@ -1,7 +1,13 @@
 module github.com/threeq/gosm
 
-go 1.14
+go 1.18
 
 require (
 	github.com/threeq/goassert v0.0.1
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
 )
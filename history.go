@@ -0,0 +1,132 @@
+package gosm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// HistoryStore 保存实体离开状态机时最后的活动状态，state 为 FormatState 的结果
+type HistoryStore interface {
+	Save(ctx context.Context, machine, entityID, state string) error
+	Load(ctx context.Context, machine, entityID string) (state string, ok bool, err error)
+}
+
+// NewMemoryHistoryStore 保存在内存中的 HistoryStore
+func NewMemoryHistoryStore() HistoryStore {
+	return &memoryHistoryStore{states: make(map[string]string)}
+}
+
+type memoryHistoryStore struct {
+	lock   sync.RWMutex
+	states map[string]string
+}
+
+func (o *memoryHistoryStore) Save(ctx context.Context, machine, entityID, state string) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.states[machine+"/"+entityID] = state
+	return nil
+}
+
+func (o *memoryHistoryStore) Load(ctx context.Context, machine, entityID string) (string, bool, error) {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	state, ok := o.states[machine+"/"+entityID]
+	return state, ok, nil
+}
+
+// History 设置保存历史状态的存储，没有设置时声明历史入口会使用 NewMemoryHistoryStore
+func History(store HistoryStore) Option {
+	return func(machine *StateMachine) {
+		machine.history = store
+	}
+}
+
+// ShallowHistory 浅历史入口 [H]：进入上次离开时所处的本状态机的状态（子状态机从开始状态进入），
+// 没有历史时进入开始状态
+func (o *StateMachine) ShallowHistory(desc string, actions ...Action) StateEntry {
+	return o.historyEntry(false, desc, actions)
+}
+
+// DeepHistory 深历史入口 [H*]：进入上次离开时所处的最内层状态，没有历史时进入开始状态
+func (o *StateMachine) DeepHistory(desc string, actions ...Action) StateEntry {
+	return o.historyEntry(true, desc, actions)
+}
+
+func (o *StateMachine) historyEntry(deep bool, desc string, actions []Action) StateEntry {
+	if o.history == nil {
+		o.history = NewMemoryHistoryStore()
+	}
+	id := "[H]"
+	if deep {
+		id = "[H*]"
+	}
+	return &historyStateEntry{
+		normalStateEntry: normalStateEntry{state: State(id, "history"), actions: actions, desc: desc},
+		machine:          o,
+		deep:             deep,
+	}
+}
+
+type historyStateEntry struct {
+	normalStateEntry
+	machine *StateMachine
+	deep    bool
+}
+
+// resolve 实体进入的状态
+func (o *historyStateEntry) resolve(c context.Context, entity Entity) (IState, error) {
+	text, ok, err := o.machine.history.Load(c, o.machine.Name, entity.ID())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if len(o.machine.starts) == 0 {
+			return nil, fmt.Errorf("状态机 %s 没有历史状态和开始状态", o.machine.Name)
+		}
+		return o.machine.starts[0], nil
+	}
+	s, err := o.machine.ParseState(text)
+	if err != nil || o.deep {
+		return s, err
+	}
+	for _, l := range levels(s, o.machine) {
+		if l.machine == o.machine {
+			return l.state, nil
+		}
+	}
+	return s, nil
+}
+
+func (o *historyStateEntry) Graph(exit *StateExit) (string, string) {
+	name := o.machine.Name
+	if o.machine.parent != nil {
+		name = fmt.Sprint(o.machine.parent.ID())
+	}
+	line := fmt.Sprintf("%v --> %v%v :%v<%v>", exit.state.ID(), name, o.state.ID(), exit.event, exit.desc)
+	if exit.state.Machine() == nil || exit.state.Machine() == o.machine {
+		return "", line
+	}
+	m, l := o.machine.Graph(exit.state.Machine().steps)
+	return m, line + "\n" + l
+}
+
+// remember 实体离开状态机时保存历史状态
+func (o *StateMachine) remember(c context.Context, entity Entity, state IState, trans *Transition) error {
+	staying := make(map[*StateMachine]bool)
+	for _, l := range levels(trans.To, o) {
+		staying[l.machine] = true
+	}
+	for _, s := range trans.Exited {
+		m := machineOf(s, o)
+		if m.history == nil || staying[m] {
+			continue
+		}
+		staying[m] = true
+		if err := m.history.Save(c, m.Name, entity.ID(), FormatState(state)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"testing"
+)
+
+type testHistoryStore struct {
+	HistoryStore
+	err error
+}
+
+func (o *testHistoryStore) Save(ctx context.Context, machine, entityID, state string) error {
+	if o.err != nil {
+		return o.err
+	}
+	return o.HistoryStore.Save(ctx, machine, entityID, state)
+}
+
+func (o *testHistoryStore) Load(ctx context.Context, machine, entityID string) (string, bool, error) {
+	if o.err != nil {
+		return "", false, o.err
+	}
+	return o.HistoryStore.Load(ctx, machine, entityID)
+}
+
+func TestStateMachine_ShallowHistory(t *testing.T) {
+	registry := NewMachineRegistry()
+	store := &testHistoryStore{HistoryStore: NewMemoryHistoryStore()}
+	review := NewMachine("TestStateMachine_ShallowHistory_review", Machines(registry), History(store))
+	sm := NewMachine("TestStateMachine_ShallowHistory", Machines(registry))
+
+	sm.Trans(sm.State("draft").Exit("submit", ""), review.Entry(review.State("checking"), ""))
+	sm.Trans(sm.State("suspended").Exit("resume", ""), review.ShallowHistory(""))
+	review.Trans(review.State("checking").Exit("pass", ""), review.State("approving").Entry(""))
+	review.Trans(review.State("checking").Exit("suspend", ""), sm.State("suspended").Entry(""))
+	review.Trans(review.State("approving").Exit("suspend", ""), sm.State("suspended").Entry(""))
+	sm.Show()
+
+	entity := NewMutableTestEntity("1", sm.State("draft"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "submit")).Equal(nil)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pass")).Equal(nil)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "suspend")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("suspended")
+
+	simulation, err := sm.Simulate(context.Background(), entity, "resume")
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, simulation.Transition.To.ID()).Equal("approving")
+
+	goassert.That(t, sm.Trigger(context.Background(), entity, "resume")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("approving")
+	goassert.That(t, entity.s.Machine()).Equal(review)
+
+	// 没有历史时进入开始状态
+	other := NewMutableTestEntity("2", sm.State("suspended"))
+	goassert.That(t, sm.Trigger(context.Background(), other, "resume")).Equal(nil)
+	goassert.That(t, other.s.ID()).Equal("checking")
+
+	store.err = errors.New("store")
+	err = sm.Trigger(context.Background(), entity, "suspend")
+	goassert.That(t, errors.Is(err, ErrCommitFailed)).Equal(true)
+	goassert.That(t, entity.s.ID()).Equal("approving")
+	err = sm.Trigger(context.Background(), NewMutableTestEntity("3", sm.State("suspended")), "resume")
+	goassert.That(t, errors.Is(err, ErrActionFailed)).Equal(true)
+	goassert.That(t, errors.Is(err, store.err)).Equal(true)
+
+	data, err := Marshal(sm, YAML)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, string(data)).Contains("to: '[H]'\n  machine: TestStateMachine_ShallowHistory_review\n")
+	builder := NewBuilder().Machines(registry)
+	goassert.That(t, builder.Load(data, YAML)).Equal(nil)
+	loaded, err := builder.TryBuild("TestStateMachine_ShallowHistory_loaded")
+	goassert.That(t, err).Equal(nil)
+	again, err := NewDefinition(loaded)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, again.Transitions[1].To).Equal("[H]")
+}
+
+func TestStateMachine_DeepHistory(t *testing.T) {
+	var records []string
+	express := false
+	sm := hsmMachine("TestStateMachine_DeepHistory", &records, &express)
+	processing := sm.Child(sm.State("processing"))
+	sm.Trans(sm.State("cancelled").Exit("resume", ""), processing.ShallowHistory(""))
+	sm.Trans(sm.State("cancelled").Exit("restore", ""), processing.DeepHistory(""))
+	sm.Show()
+
+	entity := NewMutableTestEntity("1", sm.State("created"))
+	for _, event := range []Event{"pay", "pick", "box", "cancel"} {
+		goassert.That(t, sm.Trigger(context.Background(), entity, event)).Equal(nil)
+	}
+	goassert.That(t, entity.s.ID()).Equal("cancelled")
+
+	tests := []struct {
+		event   Event
+		to      interface{}
+		entered []interface{}
+	}{
+		{"resume", "boxing", []interface{}{"processing", "packing", "boxing"}},
+		{"restore", "boxed", []interface{}{"processing", "packing", "boxed"}},
+	}
+	for _, tt := range tests {
+		simulation, err := sm.Simulate(context.Background(), entity, tt.event)
+		goassert.That(t, err).Equal(nil)
+		goassert.That(t, simulation.Transition.To.ID()).Equal(tt.to)
+		goassert.That(t, ids(simulation.Transition.Entered)).Equal(tt.entered)
+	}
+
+	goassert.That(t, sm.Trigger(context.Background(), entity, "restore")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("boxed")
+}
+
+func TestStateMachine_HistoryValidate(t *testing.T) {
+	sub := NewMachine("TestStateMachine_HistoryValidate_sub", Machines(nil))
+	sm := NewMachine("TestStateMachine_HistoryValidate", Machines(nil))
+	sm.Entry(sm.State("s1"), "")
+	sm.Trans(sm.State("s1").Exit("e1", ""), sub.DeepHistory(""))
+
+	problems := sm.Validate()
+	goassert.That(t, len(problems)).Equal(1)
+	goassert.That(t, problems[0].Code).Equal(ProblemUndefinedLink)
+}
@@ -0,0 +1,147 @@
+package gosm
+
+import (
+	"context"
+	"fmt"
+)
+
+// Compose parent 成为组合状态，拥有子状态机 sub：
+// 进入 parent 时继续进入 sub 的开始状态（执行 sub.Entry 声明的动作），实体的状态为最内层的状态；
+// 最内层状态没有处理的事件逐级交给外层的组合状态处理。
+// 离开、进入的状态按照最近公共祖先计算，记录在 Transition.Exited、Transition.Entered 中
+func (o *StateMachine) Compose(parent IState, sub *StateMachine) {
+	if sub == o || sub.parent != nil {
+		panic(fmt.Sprintf("状态机 %s 已经属于其它组合状态", sub.Name))
+	}
+	parent.Bind(o)
+	sub.parent = parent
+	if o.children == nil {
+		o.children = make(map[interface{}]*StateMachine)
+	}
+	o.children[parent.ID()] = sub
+}
+
+// Parent 子状态机所属的组合状态，不是子状态机时为 nil
+func (o *StateMachine) Parent() IState {
+	return o.parent
+}
+
+// Child 组合状态 s 拥有的子状态机，不是组合状态时为 nil
+func (o *StateMachine) Child(s IState) *StateMachine {
+	return o.children[s.ID()]
+}
+
+// level 层次状态机中的一层：状态以及它所属的状态机
+type level struct {
+	state   IState
+	machine *StateMachine
+}
+
+func (o level) is(other level) bool {
+	return o.machine == other.machine && o.state.ID() == other.state.ID()
+}
+
+// levels s 以及包含它的组合状态，从内到外排列。s 没有绑定状态机时属于 def
+func levels(s IState, def *StateMachine) []level {
+	var ls []level
+	for s != nil {
+		m := machineOf(s, def)
+		ls = append(ls, level{state: s, machine: m})
+		s, def = m.parent, m
+	}
+	return ls
+}
+
+// path 执行 transition 时离开和进入的状态。
+// 离开的状态从当前状态 state 开始，到源状态和目标状态的最近公共祖先为止（不包括），
+// 进入的状态从最近公共祖先开始（不包括）到目标状态 target，fork 的目标状态（伪状态）不包括在内
+func (o *StateMachine) path(state IState, transition *ConditionLinker, target IState) (exited, entered []level) {
+	m := machineOf(transition.exit.state, o)
+	combo, isCombo := transition.entry.(*comboStateEntry)
+	if isCombo {
+		target = combo.fork
+	}
+
+	source := levels(transition.exit.state, m)
+	targets := levels(target, m)
+	lca := -1
+	for _, s := range source[1:] {
+		for i, t := range targets[1:] {
+			if s.is(t) {
+				lca = i + 1
+				break
+			}
+		}
+		if lca > 0 {
+			break
+		}
+	}
+
+	for _, l := range levels(state, o) {
+		if lca > 0 && l.is(targets[lca]) {
+			break
+		}
+		exited = append(exited, l)
+	}
+	if lca < 0 {
+		lca = len(targets)
+	}
+	for i := lca - 1; i >= 0; i-- {
+		entered = append(entered, targets[i])
+	}
+	if isCombo {
+		entered = entered[:len(entered)-1]
+	}
+	return exited, entered
+}
+
+// descend 从组合状态开始逐级进入子状态机的开始状态
+func descend(l level) []level {
+	var entered []level
+	for {
+		sub := l.machine.children[l.state.ID()]
+		if sub == nil || len(sub.starts) == 0 {
+			return entered
+		}
+		l = level{state: sub.starts[0], machine: sub}
+		entered = append(entered, l)
+	}
+}
+
+// exitStates 从内到外执行离开状态的 OnExit 动作，to 为转换的目标状态
+func exitStates(c context.Context, entity Entity, exited []level, to IState) error {
+	for _, l := range exited {
+		for _, action := range l.machine.onExit[l.state.ID()] {
+			if err := action(c, entity, l.state, to); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// enterStates 从外到内执行进入状态的 OnEntry 动作，from 为转换的源状态。
+// 最后 descent 个状态是进入的子状态机开始状态，先执行 sub.Entry 声明的动作
+func enterStates(c context.Context, entity Entity, from IState, entered []level, descent int) error {
+	for i, l := range entered {
+		if i >= len(entered)-descent && l.machine.initial != nil {
+			if err := l.machine.initial.Action(c, entity, l.machine.parent, l.state); err != nil {
+				return err
+			}
+		}
+		for _, action := range l.machine.onEntry[l.state.ID()] {
+			if err := action(c, entity, from, l.state); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func states(ls []level) []IState {
+	var ss []IState
+	for _, l := range ls {
+		ss = append(ss, l.state)
+	}
+	return ss
+}
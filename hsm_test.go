@@ -0,0 +1,133 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"testing"
+)
+
+func hsmMachine(name string, records *[]string, express *bool) *StateMachine {
+	record := func(name string) Action {
+		return func(ctx context.Context, entity Entity, from, to IState) error {
+			*records = append(*records, name)
+			return nil
+		}
+	}
+	top := NewMachine(name, Machines(nil))
+	processing := NewMachine(name+"_processing", Machines(nil))
+	packing := NewMachine(name+"_packing", Machines(nil))
+	top.Compose(top.State("processing"), processing)
+	processing.Compose(processing.State("packing"), packing)
+	processing.Entry(processing.State("picking"), "", record("init picking"))
+	packing.Entry(packing.State("boxing"), "", record("init boxing"))
+
+	top.Trans(top.State("created").Exit("pay", ""), top.State("processing").Entry("pay", record("pay")))
+	top.Trans(top.State("processing").Exit("cancel", ""), top.State("cancelled").Entry("", record("cancel")))
+	top.Trans(top.State("processing").Exit("reset", ""), top.State("processing").Entry(""))
+	processing.Trans(processing.State("picking").Exit("pick", ""), processing.State("packing").Entry(""))
+	processing.Trans(processing.State("picking").Exit("cancel", "express", func(ctx context.Context, entity Entity, from, to IState) bool {
+		return *express
+	}), processing.State("picking").Entry("", record("skip cancel")))
+	packing.Trans(packing.State("boxing").Exit("box", ""), packing.State("boxed").Entry(""))
+	packing.Trans(packing.State("boxing").Exit("abort", ""), top.State("cancelled").Entry(""))
+	return top
+}
+
+func TestStateMachine_Compose(t *testing.T) {
+	var records []string
+	express := false
+	sm := hsmMachine("TestStateMachine_Compose", &records, &express)
+	sm.Show()
+	processing := sm.Child(sm.State("processing"))
+	packing := processing.Child(processing.State("packing"))
+	goassert.That(t, processing.Parent().ID()).Equal("processing")
+	goassert.That(t, len(sm.Submachines())).Equal(2)
+
+	entity := NewMutableTestEntity("1", State("created"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("picking")
+	goassert.That(t, records).Equal([]string{"pay", "init picking"})
+
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pick")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("boxing")
+	goassert.That(t, entity.s.Machine()).Equal(packing)
+
+	events, err := sm.AvailableEvents(context.Background(), entity)
+	goassert.That(t, err).Equal(nil)
+	var names []Event
+	for _, e := range events {
+		names = append(names, e.Event)
+	}
+	goassert.That(t, names).Equal([]Event{"box", "abort", "cancel", "reset"})
+
+	// 事件逐级向外冒泡
+	goassert.That(t, sm.Trigger(context.Background(), entity, "cancel")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("cancelled")
+	goassert.That(t, records[len(records)-1]).Equal("cancel")
+
+	err = sm.Trigger(context.Background(), NewMutableTestEntity("1", packing.State("boxing")), "ship")
+	goassert.That(t, errors.Is(err, ErrUnknownEvent)).Equal(true)
+}
+
+func TestStateMachine_ComposePath(t *testing.T) {
+	var records []string
+	express := false
+	sm := hsmMachine("TestStateMachine_ComposePath", &records, &express)
+	processing := sm.Child(sm.State("processing"))
+	packing := processing.Child(processing.State("packing"))
+
+	tests := []struct {
+		name    string
+		state   IState
+		event   Event
+		express bool
+		to      interface{}
+		exited  []interface{}
+		entered []interface{}
+	}{
+		{"enter composite", sm.State("created"), "pay", false, "picking",
+			[]interface{}{"created"}, []interface{}{"processing", "picking"}},
+		{"inner transition", processing.State("picking"), "pick", false, "boxing",
+			[]interface{}{"picking"}, []interface{}{"packing", "boxing"}},
+		{"bubble", packing.State("boxing"), "cancel", false, "cancelled",
+			[]interface{}{"boxing", "packing", "processing"}, []interface{}{"cancelled"}},
+		{"bubble on guard", processing.State("picking"), "cancel", false, "cancelled",
+			[]interface{}{"picking", "processing"}, []interface{}{"cancelled"}},
+		{"inner first", processing.State("picking"), "cancel", true, "picking",
+			[]interface{}{"picking"}, []interface{}{"picking"}},
+		{"self transition", packing.State("boxing"), "reset", false, "picking",
+			[]interface{}{"boxing", "packing", "processing"}, []interface{}{"processing", "picking"}},
+		{"leave to outer", packing.State("boxing"), "abort", false, "cancelled",
+			[]interface{}{"boxing", "packing", "processing"}, []interface{}{"cancelled"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			express = tt.express
+			simulation, err := sm.Simulate(context.Background(), NewMutableTestEntity("1", tt.state), tt.event)
+			goassert.That(t, err).Equal(nil)
+			goassert.That(t, simulation.Transition.To.ID()).Equal(tt.to)
+			goassert.That(t, ids(simulation.Transition.Exited)).Equal(tt.exited)
+			goassert.That(t, ids(simulation.Transition.Entered)).Equal(tt.entered)
+		})
+	}
+	goassert.That(t, len(records)).Equal(0)
+}
+
+func TestStateMachine_ComposeValidate(t *testing.T) {
+	sm := NewMachine("TestStateMachine_ComposeValidate", Machines(nil))
+	sub := NewMachine("TestStateMachine_ComposeValidate_sub", Machines(nil))
+	sm.Entry(sm.State("s1"), "")
+	sm.Trans(sm.State("s1").Exit("e1", ""), sm.State("s2").Entry(""))
+	sm.Trans(sm.State("s2").Exit("e2", ""), sm.State("s1").Entry(""))
+	sm.Compose(sm.State("s2"), sub)
+
+	problems := sm.Validate()
+	goassert.That(t, len(problems)).Equal(1)
+	goassert.That(t, problems[0].Code).Equal(ProblemNoInitial)
+
+	defer func() {
+		goassert.That(t, recover()).NotEqual(nil)
+	}()
+	sm.Compose(sm.State("s1"), sub)
+}
@@ -0,0 +1,194 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Starts 通过 StateMachine.Entry 声明的开始状态
+func (o *StateMachine) Starts() []IState {
+	return append([]IState(nil), o.starts...)
+}
+
+// Ends 通过 StateMachine.Exit 声明的结束状态
+func (o *StateMachine) Ends() []IState {
+	return append([]IState(nil), o.ends...)
+}
+
+// States 状态机中的所有状态（不包括其它状态机的状态、伪状态和 [*]），
+// 按照开始状态、转换定义的顺序排列，其余的按 ID 排序
+func (o *StateMachine) States() []IState {
+	var states []IState
+	seen := make(map[interface{}]bool)
+	add := func(s IState) {
+		if seen[s.ID()] || s.ID() == "[*]" || isPseudoState(s) ||
+			(s.Machine() != nil && s.Machine() != o) {
+			return
+		}
+		seen[s.ID()] = true
+		states = append(states, s)
+	}
+
+	for _, s := range o.starts {
+		add(s)
+	}
+	for _, linker := range o.linkers {
+		add(linker.exit.state)
+		if combo, ok := linker.entry.(*comboStateEntry); ok {
+			for _, entry := range combo.stateEntries {
+				add(entry.State())
+			}
+			if combo.join != nil && combo.join.entry != nil {
+				add(combo.join.entry.State())
+			}
+		} else {
+			add(linker.entry.State())
+		}
+	}
+
+	var others []IState
+	for _, s := range o.states {
+		if !seen[s.ID()] {
+			others = append(others, s)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool {
+		return fmt.Sprint(others[i].ID()) < fmt.Sprint(others[j].ID())
+	})
+	for _, s := range others {
+		add(s)
+	}
+	return states
+}
+
+// Transitions 按照定义的顺序返回所有转换，fork 的分支在 Transition.Branches 中
+func (o *StateMachine) Transitions() []*Transition {
+	var transitions []*Transition
+	for _, linker := range o.linkers {
+		transitions = append(transitions, linker.transition())
+	}
+	return transitions
+}
+
+// Events 状态可以接受的事件，按照定义的顺序排列
+func (o *StateMachine) Events(s IState) []Event {
+	var events []Event
+	seen := make(map[Event]bool)
+	for _, linker := range o.linkers {
+		if linker.exit.state.ID() == s.ID() && !seen[linker.exit.event] {
+			seen[linker.exit.event] = true
+			events = append(events, linker.exit.event)
+		}
+	}
+	return events
+}
+
+// Submachines 通过 Link 可以到达的其它状态机和组合状态的子状态机，包括间接链接的状态机
+func (o *StateMachine) Submachines() []*StateMachine {
+	var machines []*StateMachine
+	seen := map[*StateMachine]bool{o: true}
+	queue := []*StateMachine{o}
+	for len(queue) > 0 {
+		sm := queue[0]
+		queue = queue[1:]
+		for _, linked := range sm.linked() {
+			if !seen[linked] {
+				seen[linked] = true
+				machines = append(machines, linked)
+				queue = append(queue, linked)
+			}
+		}
+	}
+	return machines
+}
+
+// linked 直接链接的状态机
+func (o *StateMachine) linked() []*StateMachine {
+	var machines []*StateMachine
+	add := func(entry StateEntry) {
+		if history, ok := entry.(*historyStateEntry); ok && history.machine != o {
+			machines = append(machines, history.machine)
+		}
+		if m := entry.State().Machine(); m != nil && m != o {
+			machines = append(machines, m)
+		}
+	}
+	for _, linker := range o.linkers {
+		if combo, ok := linker.entry.(*comboStateEntry); ok {
+			for _, entry := range combo.stateEntries {
+				add(entry)
+			}
+			if combo.join != nil && combo.join.entry != nil {
+				add(combo.join.entry)
+			}
+		} else {
+			add(linker.entry)
+		}
+	}
+	for _, s := range o.States() {
+		if sub := o.children[s.ID()]; sub != nil {
+			machines = append(machines, sub)
+		}
+	}
+	return machines
+}
+
+// AvailableEvent 事件在当前状态下能否触发。
+// Passed 为条件检查通过的转换，Rejected 为之前条件检查失败的转换
+type AvailableEvent struct {
+	Event     Event
+	Available bool
+	Passed    *Transition
+	Rejected  []*Transition
+}
+
+// AvailableEvents 按照定义的顺序检查实体当前状态下每个事件的条件，不执行任何动作。
+// 实体处于并发区域时检查所有区域的事件。实体状态没有定义时返回 ErrUnknownState
+func (o *StateMachine) AvailableEvents(c context.Context, entity Entity) ([]*AvailableEvent, error) {
+	state := entity.State()
+	if _, parallel := state.(*Configuration); !parallel {
+		if _, err := o.lookup(entity, state, nil); errors.Is(err, ErrUnknownState) {
+			return nil, err
+		}
+	}
+
+	var events []*AvailableEvent
+	for _, event := range o.acceptable(state) {
+		trans, rejected, err := o.fire(c, entity, state, event, true)
+		events = append(events, &AvailableEvent{Event: event, Available: err == nil, Passed: trans, Rejected: rejected})
+	}
+	return events, nil
+}
+
+// acceptable 状态可以接受的事件，包括外层组合状态的事件；并发区域为所有区域事件的并集。
+// 不包括完成转换的 Completion
+func (o *StateMachine) acceptable(s IState) []Event {
+	var events []Event
+	seen := make(map[Event]bool)
+	ps, parallel := s.(*Configuration)
+	if !parallel {
+		for _, l := range levels(s, o) {
+			for _, event := range l.machine.Events(l.state) {
+				if !seen[event] && event != Completion {
+					seen[event] = true
+					events = append(events, event)
+				}
+			}
+		}
+		return events
+	}
+	for _, region := range ps.regions {
+		if region == nil {
+			continue
+		}
+		for _, event := range machineOf(region, o).acceptable(region) {
+			if !seen[event] {
+				seen[event] = true
+				events = append(events, event)
+			}
+		}
+	}
+	return events
+}
@@ -0,0 +1,88 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"testing"
+)
+
+func ids(states []IState) []interface{} {
+	var ids []interface{}
+	for _, s := range states {
+		ids = append(ids, s.ID())
+	}
+	return ids
+}
+
+func TestStateMachine_Inspect(t *testing.T) {
+	m3 := NewMachine("TestStateMachine_Inspect_m3", Machines(nil))
+	m3.Trans(m3.State("z1").Exit("e1", ""), m3.State("z2").Entry(""))
+
+	m1 := NewMachine("TestStateMachine_Inspect_m1", Machines(nil))
+	m1.Trans(m1.State("x1").Exit("e1", ""), m3.Entry(m3.State("z1"), ""))
+
+	m2 := NewMachine("TestStateMachine_Inspect_m2", Machines(nil))
+	m2.State("lonely")
+	m2.Entry(State("s1"), "")
+	m2.Trans(State("s1").Exit("e1", "c1", Any), State("s2").Entry("a1", Noop))
+	m2.Trans(State("s1").Exit("e1", "c2", Any), State("s3").Entry("a2", Noop))
+	m2.Trans(State("s2").Exit("e2", ""), m1.Entry(m1.State("x1"), ""))
+	m2.Fork(State("s1").Exit("e3", "")).Link(Serial(All), State("s4").Entry("b1"), m3.Entry(m3.State("z1"), "b2"))
+	m2.Exit(State("s3"), "e4", "").End()
+
+	goassert.That(t, ids(m2.Starts())).Equal([]interface{}{"s1"})
+	goassert.That(t, ids(m2.Ends())).Equal([]interface{}{"s3"})
+	goassert.That(t, ids(m2.States())).Equal([]interface{}{"s1", "s2", "s3", "s4", "lonely"})
+	goassert.That(t, m2.Events(State("s1"))).Equal([]Event{"e1", "e3"})
+	goassert.That(t, len(m2.Events(State("s4")))).Equal(0)
+
+	transitions := m2.Transitions()
+	goassert.That(t, len(transitions)).Equal(5)
+	goassert.That(t, transitions[1].CondDesc).Equal("c2")
+	goassert.That(t, transitions[1].ActionDesc).Equal("a2")
+	goassert.That(t, transitions[1].To.ID()).Equal("s3")
+	goassert.That(t, len(transitions[3].Branches)).Equal(2)
+	goassert.That(t, transitions[3].Branches[1].ActionDesc).Equal("b2")
+	goassert.That(t, transitions[3].Branches[1].To.Machine()).Equal(m3)
+
+	goassert.That(t, m2.Submachines()).Equal([]*StateMachine{m1, m3})
+	goassert.That(t, m3.Submachines() == nil).Equal(true)
+}
+
+func TestStateMachine_AvailableEvents(t *testing.T) {
+	never := func(ctx context.Context, entity Entity, from, to IState) bool { return false }
+	executed := false
+	action := func(ctx context.Context, entity Entity, from, to IState) error {
+		executed = true
+		return nil
+	}
+
+	sm := NewMachine("TestStateMachine_AvailableEvents", Machines(nil))
+	sm.Trans(State("s1").Exit("pay", "never", never), State("s2").Entry("", action))
+	sm.Trans(State("s1").Exit("pay", "always", Any), State("s3").Entry("", action))
+	sm.Trans(State("s1").Exit("cancel", "never", never), State("s4").Entry("", action))
+	sm.Trans(State("s1").Exit("ship", ""), State("s5").Entry("", action))
+
+	events, err := sm.AvailableEvents(context.Background(), NewMutableTestEntity("1", State("s1")))
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, executed).Equal(false)
+	goassert.That(t, len(events)).Equal(3)
+
+	goassert.That(t, events[0].Event).Equal("pay")
+	goassert.That(t, events[0].Available).Equal(true)
+	goassert.That(t, events[0].Passed.CondDesc).Equal("always")
+	goassert.That(t, events[0].Passed.To.ID()).Equal("s3")
+	goassert.That(t, events[0].Rejected[0].CondDesc).Equal("never")
+
+	goassert.That(t, events[1].Event).Equal("cancel")
+	goassert.That(t, events[1].Available).Equal(false)
+	goassert.That(t, events[1].Passed == nil).Equal(true)
+	goassert.That(t, len(events[1].Rejected)).Equal(1)
+
+	goassert.That(t, events[2].Available).Equal(true)
+	goassert.That(t, len(events[2].Rejected)).Equal(0)
+
+	_, err = sm.AvailableEvents(context.Background(), NewMutableTestEntity("1", State("s9")))
+	goassert.That(t, errors.Is(err, ErrUnknownState)).Equal(true)
+}
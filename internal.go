@@ -0,0 +1,25 @@
+package gosm
+
+import (
+	"fmt"
+)
+
+// Internal 内部转换：实体处于 exit 的状态（或者它的子状态）时只执行动作，不离开、不进入任何状态，
+// 不执行 OnExit、OnEntry，不保存历史状态，也不重新开始计时。
+// 使用 Trans 定义的目标状态为自身的转换是外部自转换，会离开并重新进入状态
+func (o *StateMachine) Internal(exit *StateExit, desc string, actions ...Action) {
+	o.Trans(exit, &internalStateEntry{normalStateEntry{state: exit.state, actions: actions, desc: desc}})
+}
+
+type internalStateEntry struct {
+	normalStateEntry
+}
+
+// Graph 内部转换显示在状态的描述中
+func (o *internalStateEntry) Graph(exit *StateExit) (string, string) {
+	line := fmt.Sprintf("%v : %v<%v>", o.state.ID(), exit.event, exit.desc)
+	if o.desc != "" {
+		line += " / " + o.desc
+	}
+	return "", line
+}
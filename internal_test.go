@@ -0,0 +1,99 @@
+package gosm
+
+import (
+	"context"
+	"github.com/threeq/goassert"
+	"strings"
+	"testing"
+)
+
+type testTransFilter struct {
+	trans []*Transition
+}
+
+func (o *testTransFilter) Before(ctx context.Context, entity Entity, event Event) Entity {
+	return entity
+}
+
+func (o *testTransFilter) After(ctx context.Context, entity Entity, trans *Transition, result error) {
+	o.trans = append(o.trans, trans)
+}
+
+func TestStateMachine_Internal(t *testing.T) {
+	var records []string
+	express := false
+	filter := &testTransFilter{}
+	sm := hsmMachine("TestStateMachine_Internal", &records, &express)
+	Aspect(filter)(sm)
+	processing := sm.Child(sm.State("processing"))
+	packing := processing.Child(processing.State("packing"))
+	record := func(name string) Action {
+		return func(ctx context.Context, entity Entity, from, to IState) error {
+			records = append(records, name)
+			return nil
+		}
+	}
+	sm.Internal(sm.State("processing").Exit("remind", ""), "notify", record("notify"))
+	sm.OnEntry(sm.State("processing"), record("entry processing"))
+	sm.OnExit(sm.State("processing"), record("exit processing"))
+	packing.OnExit(packing.State("boxing"), record("exit boxing"))
+
+	// 内部转换：不离开子状态
+	entity := NewMutableTestEntity("1", packing.State("boxing"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "remind")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("boxing")
+	goassert.That(t, records).Equal([]string{"notify"})
+	trans := filter.trans[0]
+	goassert.That(t, trans.Internal).Equal(true)
+	goassert.That(t, len(trans.Exited)).Equal(0)
+	goassert.That(t, len(trans.Entered)).Equal(0)
+
+	// 外部自转换：离开并重新进入，子状态机从开始状态进入
+	records = nil
+	goassert.That(t, sm.Trigger(context.Background(), entity, "reset")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("picking")
+	goassert.That(t, records).Equal([]string{"exit boxing", "exit processing", "entry processing", "init picking"})
+	trans = filter.trans[1]
+	goassert.That(t, trans.Internal).Equal(false)
+	goassert.That(t, trans.Exited[len(trans.Exited)-1].ID()).Equal("processing")
+	goassert.That(t, trans.Entered[0].ID()).Equal("processing")
+
+	graph, text := sm.Graph(map[*StateMachine]bool{})
+	goassert.That(t, graph).NotEqual("")
+	goassert.That(t, strings.Contains(text, "processing : remind<Any> / notify")).Equal(true)
+}
+
+func TestBuilder_DSLInternal(t *testing.T) {
+	var records []string
+	registry := NewRegistry(nil).RegisterAction("notify", func(ctx context.Context, entity Entity, from, to IState) error {
+		records = append(records, "notify")
+		return nil
+	})
+	builder := NewBuilder().Registry(registry)
+	err := builder.DSL(`
+s1 -> s2 : e1
+s2 : remind / notify
+s2 -> s2 : reset`)
+	goassert.That(t, err).Equal(nil)
+	sm := builder.Build("TestBuilder_DSLInternal", Machines(nil))
+
+	entity := NewMutableTestEntity("1", State("s2"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "remind")).Equal(nil)
+	goassert.That(t, records).Equal([]string{"notify"})
+
+	data, err := Marshal(sm, YAML)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, string(data)).Contains("- from: s2\n  event: remind\n  to: s2\n  action: notify\n  internal: true\n")
+
+	builder = NewBuilder().Registry(registry)
+	goassert.That(t, builder.Load(data, YAML)).Equal(nil)
+	loaded, err := builder.TryBuild("TestBuilder_DSLInternal_loaded", Machines(nil))
+	goassert.That(t, err).Equal(nil)
+	again, err := NewDefinition(loaded)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, again.Transitions[1].Internal).Equal(true)
+	goassert.That(t, again.Transitions[2].Internal).Equal(false)
+
+	err = builder.Definition(&Definition{Transitions: []*TransitionDef{{From: "s1", Event: "e1", To: "s2", Internal: true}}})
+	goassert.That(t, err).NotEqual(nil)
+}
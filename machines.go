@@ -0,0 +1,91 @@
+package gosm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DefaultMachines 全局状态机注册表，NewMachine、Builder 默认注册到这里
+var DefaultMachines = NewMachineRegistry()
+
+// ErrDuplicateMachine 状态机名字已经注册
+type ErrDuplicateMachine struct {
+	Name string
+}
+
+func (o *ErrDuplicateMachine) Error() string {
+	return fmt.Sprintf("状态机 %s 重复注册", o.Name)
+}
+
+// MachineRegistry 并发安全的状态机注册表，按状态机名字索引
+type MachineRegistry struct {
+	lock     sync.RWMutex
+	machines map[string]*StateMachine
+}
+
+func NewMachineRegistry() *MachineRegistry {
+	return &MachineRegistry{machines: make(map[string]*StateMachine)}
+}
+
+// Register 名字已经存在时返回 *ErrDuplicateMachine
+func (o *MachineRegistry) Register(sm *StateMachine) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if _, has := o.machines[sm.Name]; has {
+		return &ErrDuplicateMachine{Name: sm.Name}
+	}
+	o.machines[sm.Name] = sm
+	return nil
+}
+
+// put 名字已经存在时替换
+func (o *MachineRegistry) put(sm *StateMachine) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.machines[sm.Name] = sm
+}
+
+func (o *MachineRegistry) Unregister(name string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.machines, name)
+}
+
+// Get 没有注册时返回 nil
+func (o *MachineRegistry) Get(name string) *StateMachine {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	return o.machines[name]
+}
+
+// List 按名字排序
+func (o *MachineRegistry) List() []*StateMachine {
+	o.lock.RLock()
+	machines := make([]*StateMachine, 0, len(o.machines))
+	for _, sm := range o.machines {
+		machines = append(machines, sm)
+	}
+	o.lock.RUnlock()
+
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].Name < machines[j].Name
+	})
+	return machines
+}
+
+func Register(sm *StateMachine) error {
+	return DefaultMachines.Register(sm)
+}
+
+func Unregister(name string) {
+	DefaultMachines.Unregister(name)
+}
+
+func Get(name string) *StateMachine {
+	return DefaultMachines.Get(name)
+}
+
+func List() []*StateMachine {
+	return DefaultMachines.List()
+}
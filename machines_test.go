@@ -0,0 +1,60 @@
+package gosm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/threeq/goassert"
+	"sync"
+	"testing"
+)
+
+func TestMachineRegistry(t *testing.T) {
+	registry := NewMachineRegistry()
+	m2 := NewMachine("m2", Machines(registry))
+	m1 := NewMachine("m1", Machines(registry))
+
+	goassert.That(t, registry.Get("m1")).Equal(m1)
+	goassert.That(t, registry.Get("m3") == nil).Equal(true)
+	goassert.That(t, registry.List()).Equal([]*StateMachine{m1, m2})
+
+	err := registry.Register(&StateMachine{Name: "m1"})
+	var duplicate *ErrDuplicateMachine
+	goassert.That(t, errors.As(err, &duplicate)).Equal(true)
+	goassert.That(t, duplicate.Name).Equal("m1")
+
+	registry.Unregister("m1")
+	goassert.That(t, registry.Get("m1") == nil).Equal(true)
+	goassert.That(t, registry.Register(&StateMachine{Name: "m1"})).Equal(nil)
+}
+
+func TestNewMachine_Isolated(t *testing.T) {
+	m := NewMachine("TestNewMachine_Isolated", Machines(nil))
+	goassert.That(t, Get(m.Name) == nil).Equal(true)
+
+	NewMachine("TestNewMachine_Duplicate")
+	defer Unregister("TestNewMachine_Duplicate")
+	_, err := TryNewMachine("TestNewMachine_Duplicate")
+	var duplicate *ErrDuplicateMachine
+	goassert.That(t, errors.As(err, &duplicate)).Equal(true)
+
+	// NewMachine 替换已经注册的状态机
+	replaced := NewMachine("TestNewMachine_Duplicate")
+	goassert.That(t, Get("TestNewMachine_Duplicate") == replaced).Equal(true)
+}
+
+func TestMachineRegistry_Concurrent(t *testing.T) {
+	registry := NewMachineRegistry()
+	wait := &sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			name := fmt.Sprintf("m%d", i%10)
+			_ = registry.Register(&StateMachine{Name: name})
+			_ = registry.Get(name)
+			_ = registry.List()
+		}(i)
+	}
+	wait.Wait()
+	goassert.That(t, len(registry.List())).Equal(10)
+}
@@ -9,10 +9,20 @@ var (
 	NoopFilter    = new(noopFilter)
 )
 
+// LockerFactory 为每个实体创建锁，Trigger 执行期间持有。
+// 锁实现 ContextLocker 时使用 LockContext 等待；否则在单独的 goroutine 中调用 Lock，
+// 因此不能使用和 goroutine 绑定的锁（例如按 goroutine 判断重入的锁），
+// 并且放弃等待的 Trigger 会留下一个 goroutine，直到获取到锁并释放为止
 type LockerFactory interface {
 	New(id string) sync.Locker
 }
 
+// ContextLocker 支持 ctx 的锁，ctx 结束时 LockContext 放弃等待并返回 ctx.Err()
+type ContextLocker interface {
+	sync.Locker
+	LockContext(ctx context.Context) error
+}
+
 // Filter Aspect
 type Filter interface {
 	Before(ctx context.Context, entity Entity, event Event) Entity
@@ -29,3 +39,23 @@ func (n *noopFilter) Before(_ context.Context, entity Entity, _ Event) Entity {
 func (n *noopFilter) After(_ context.Context, _ Entity, _ *Transition, _ error) {
 
 }
+
+// CheckedFilter After 可以返回错误的 Filter，返回错误时 MutableEntity 的状态回滚
+type CheckedFilter interface {
+	Before(ctx context.Context, entity Entity, event Event) Entity
+	After(ctx context.Context, entity Entity, trans *Transition, result error) error
+}
+
+type uncheckedFilter struct {
+	Filter
+}
+
+func (o *uncheckedFilter) After(ctx context.Context, entity Entity, trans *Transition, result error) error {
+	o.Filter.After(ctx, entity, trans, result)
+	return nil
+}
+
+// Persister 状态更新以后的持久化钩子，返回错误时 MutableEntity 的状态回滚
+type Persister interface {
+	Persist(ctx context.Context, entity MutableEntity, trans *Transition) error
+}
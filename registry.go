@@ -0,0 +1,237 @@
+package gosm
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// DefaultRegistry 全局注册表，Builder 默认从这里查找名字
+var DefaultRegistry = NewRegistry(nil)
+
+// Registry 按名字注册 Action、Condition、Executor，供 DSL、JSON、YAML 等文本定义引用。
+// 找不到的名字会继续到 parent 中查找
+type Registry struct {
+	parent     *Registry
+	lock       sync.RWMutex
+	actions    map[string]Action
+	conditions map[string]Condition
+	executors  map[string]Executor
+}
+
+func NewRegistry(parent *Registry) *Registry {
+	return &Registry{
+		parent:     parent,
+		actions:    make(map[string]Action),
+		conditions: make(map[string]Condition),
+		executors:  make(map[string]Executor),
+	}
+}
+
+func (o *Registry) RegisterAction(name string, action Action) *Registry {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.actions[name] = action
+	return o
+}
+
+func (o *Registry) RegisterCondition(name string, cond Condition) *Registry {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.conditions[name] = cond
+	return o
+}
+
+func (o *Registry) RegisterExecutor(name string, executor Executor) *Registry {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.executors[name] = executor
+	return o
+}
+
+func (o *Registry) Action(name string) (Action, bool) {
+	o.lock.RLock()
+	action, has := o.actions[name]
+	o.lock.RUnlock()
+	if !has && o.parent != nil {
+		return o.parent.Action(name)
+	}
+	return action, has
+}
+
+func (o *Registry) Condition(name string) (Condition, bool) {
+	o.lock.RLock()
+	cond, has := o.conditions[name]
+	o.lock.RUnlock()
+	if !has && o.parent != nil {
+		return o.parent.Condition(name)
+	}
+	return cond, has
+}
+
+func (o *Registry) Executor(name string) (Executor, bool) {
+	o.lock.RLock()
+	executor, has := o.executors[name]
+	o.lock.RUnlock()
+	if !has && o.parent != nil {
+		return o.parent.Executor(name)
+	}
+	return executor, has
+}
+
+func RegisterAction(name string, action Action) {
+	DefaultRegistry.RegisterAction(name, action)
+}
+
+func RegisterCondition(name string, cond Condition) {
+	DefaultRegistry.RegisterCondition(name, cond)
+}
+
+func RegisterExecutor(name string, executor Executor) {
+	DefaultRegistry.RegisterExecutor(name, executor)
+}
+
+//---------------------------------------------------------------------------------
+
+const (
+	KindAction    = "action"
+	KindCondition = "condition"
+	KindExecutor  = "executor"
+	KindMachine   = "machine"
+)
+
+// UnknownName 没有注册的名字，Line、Column 只有来自 DSL 时才有值
+type UnknownName struct {
+	Kind   string
+	Name   string
+	Line   int
+	Column int
+}
+
+func (o UnknownName) String() string {
+	if o.Line > 0 {
+		return fmt.Sprintf("dsl:%d:%d: %s %s", o.Line, o.Column, o.Kind, o.Name)
+	}
+	return fmt.Sprintf("%s %s", o.Kind, o.Name)
+}
+
+// UnknownNamesError 列出解析定义时所有没有注册的名字
+type UnknownNamesError struct {
+	Names []UnknownName
+}
+
+func (o *UnknownNamesError) Error() string {
+	var names []string
+	for _, n := range o.Names {
+		names = append(names, n.String())
+	}
+	return "名字没有注册: " + strings.Join(names, "; ")
+}
+
+// nameResolver 解析名字并收集所有找不到的名字，最后统一报错
+type nameResolver struct {
+	registry *Registry
+	machines *MachineRegistry
+	unknown  []UnknownName
+	invalid  error
+}
+
+// fail 记录第一个格式错误，err 优先返回
+func (o *nameResolver) fail(pos dslPos, format string, args ...interface{}) {
+	if o.invalid != nil {
+		return
+	}
+	if pos.line > 0 {
+		o.invalid = pos.errorf(format, args...)
+	} else {
+		o.invalid = fmt.Errorf(format, args...)
+	}
+}
+
+func (o *nameResolver) miss(kind, name string, pos dslPos) {
+	o.unknown = append(o.unknown, UnknownName{Kind: kind, Name: name, Line: pos.line, Column: pos.col})
+}
+
+// condition 空名字或 else 表示 Any
+func (o *nameResolver) condition(name string, pos dslPos) (Condition, string) {
+	if name == "" || name == "else" || name == "Any" {
+		return Any, "Any"
+	}
+	cond, has := o.registry.Condition(name)
+	if !has {
+		o.miss(KindCondition, name, pos)
+	}
+	return cond, name
+}
+
+// action 空名字表示 Noop
+func (o *nameResolver) action(name string, pos dslPos) Action {
+	if name == "" {
+		return Noop
+	}
+	action, has := o.registry.Action(name)
+	if !has {
+		o.miss(KindAction, name, pos)
+	}
+	return action
+}
+
+var (
+	executorFactories = map[string]func(SuccessStrategy) Executor{
+		"serial":   Serial,
+		"parallel": Parallel,
+	}
+	successStrategies = map[string]SuccessStrategy{
+		"all":     All,
+		"allFast": AllFast,
+		"one":     One,
+		"oneFast": OneFast,
+		"always":  Always,
+	}
+)
+
+// executor 内置 serial|parallel [, all|allFast|one|oneFast|always]（默认 all），
+// 其它名字从注册表查找
+func (o *nameResolver) executor(names []string, pos dslPos) Executor {
+	if len(names) > 2 {
+		o.fail(pos, "fork 最多两个参数: %s", strings.Join(names, ","))
+		return nil
+	}
+	if factory, has := executorFactories[names[0]]; has {
+		if len(names) == 1 {
+			return factory(All)
+		}
+		strategy, has := successStrategies[names[1]]
+		if !has {
+			o.miss(KindExecutor, strings.Join(names, ","), pos)
+		}
+		return factory(strategy)
+	}
+	executor, has := o.registry.Executor(names[0])
+	if !has || len(names) > 1 {
+		o.miss(KindExecutor, strings.Join(names, ","), pos)
+	}
+	return executor
+}
+
+// machine 子状态机需要先于引用它的状态机创建
+func (o *nameResolver) machine(name string) *StateMachine {
+	if name == "" {
+		return nil
+	}
+	sm := o.machines.Get(name)
+	if sm == nil {
+		o.miss(KindMachine, name, dslPos{})
+	}
+	return sm
+}
+
+func (o *nameResolver) err() error {
+	if o.invalid != nil {
+		return o.invalid
+	}
+	if len(o.unknown) == 0 {
+		return nil
+	}
+	return &UnknownNamesError{Names: o.unknown}
+}
@@ -0,0 +1,75 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"testing"
+)
+
+func TestRegistry_Parent(t *testing.T) {
+	parent := NewRegistry(nil).RegisterAction("a1", Noop)
+	child := NewRegistry(parent).RegisterCondition("c1", Any)
+
+	_, has := child.Action("a1")
+	goassert.That(t, has).Equal(true)
+	_, has = child.Condition("c1")
+	goassert.That(t, has).Equal(true)
+	_, has = parent.Condition("c1")
+	goassert.That(t, has).Equal(false)
+	_, has = child.Executor("e1")
+	goassert.That(t, has).Equal(false)
+}
+
+func TestBuilder_DSLRegistry(t *testing.T) {
+	var executed []string
+	registry := NewRegistry(DefaultRegistry).
+		RegisterExecutor("record", func(ctx context.Context, entity Entity, from IState, stateEntries []StateEntry) error {
+			for _, entry := range stateEntries {
+				executed = append(executed, entry.State().ID().(string))
+			}
+			return nil
+		})
+	RegisterAction("TestBuilder_DSLRegistry.move", func(ctx context.Context, entity Entity, from, to IState) error {
+		entity.(*TestEntity).s = to
+		return nil
+	})
+
+	builder := NewBuilder().Registry(registry)
+
+	err := builder.DSL(`
+s1 -> s2 : e1 / TestBuilder_DSLRegistry.move
+s2 : e2 fork(record) {
+    -> s3
+    -> s4
+}`)
+	goassert.That(t, err).Equal(nil)
+	sm := builder.Build("TestBuilder_DSLRegistry")
+
+	entity := NewTestEntity("1", State("s1"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e1")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("s2")
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e2")).Equal(nil)
+	goassert.That(t, executed).Equal([]string{"s3", "s4"})
+}
+
+func TestBuilder_DSLUnknownNames(t *testing.T) {
+	err := NewBuilder().Action("a1", Noop).DSL(`
+s1 -> s2 : e1 [c1] / a1
+s2 -> s3 : e2 / a2
+s3 : e3 fork(nope) {
+    -> s4 / a3
+}
+s3 : e4 fork(parallel, nope) {
+    -> s4
+}`)
+	var unknown *UnknownNamesError
+	goassert.That(t, errors.As(err, &unknown)).Equal(true)
+	goassert.That(t, unknown.Names).Equal([]UnknownName{
+		{Kind: KindCondition, Name: "c1", Line: 2, Column: 16},
+		{Kind: KindAction, Name: "a2", Line: 3, Column: 17},
+		{Kind: KindExecutor, Name: "nope", Line: 4, Column: 14},
+		{Kind: KindAction, Name: "a3", Line: 5, Column: 13},
+		{Kind: KindExecutor, Name: "parallel,nope", Line: 7, Column: 14},
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 )
 
 type Transition struct {
@@ -16,6 +17,14 @@ type Transition struct {
 	Action     Action
 	CondDesc   string
 	ActionDesc string
+	// Branches fork 的各个分支
+	Branches []*Transition
+	// Exited、Entered 层次状态机中离开、进入的状态，按执行顺序排列
+	Exited  []IState
+	Entered []IState
+	// Internal 内部转换，没有离开、进入任何状态，To 为实体原来的状态。
+	// 外部自转换的 Exited、Entered 中包含源状态
+	Internal bool
 }
 
 func (o *Transition) Text() string {
@@ -28,13 +37,42 @@ type StateMachine struct {
 	ends        []IState
 	states      map[interface{}]IState
 	transitions map[interface{}]map[Event][]*ConditionLinker
+	linkers     []*ConditionLinker
 
 	lockerFactory LockerFactory
-	filter        Filter
+	filter        CheckedFilter
+	persister     Persister
 
 	Name           string
+	machines       *MachineRegistry
 	linkedMachines map[string]*StateMachine
 	steps          map[*StateMachine]bool
+
+	// 层次状态机：parent 为所属的组合状态，children 为组合状态拥有的子状态机，initial 为第一个开始状态的入口
+	parent   IState
+	children map[interface{}]*StateMachine
+	initial  StateEntry
+
+	onEntry map[interface{}][]Action
+	onExit  map[interface{}][]Action
+	history HistoryStore
+
+	timers    map[interface{}][]*timer
+	scheduler *Scheduler
+
+	completionLimit int
+
+	// deferrals 状态声明的延迟事件，deferred 为每个实体的延迟队列
+	deferrals     map[interface{}][]Event
+	deferred      map[string][]Event
+	deferLimit    int
+	deferLock     sync.Mutex
+	deferredError func(entityID string, event Event, err error)
+
+	// workers 执行中的 TriggerAsync，waiting 为等待 worker 的数量
+	workers     chan struct{}
+	workerQueue int
+	waiting     int32
 }
 
 func (o *StateMachine) Trans(from *StateExit, to StateEntry) {
@@ -46,7 +84,9 @@ func (o *StateMachine) Trans(from *StateExit, to StateEntry) {
 	if !eventExist {
 		transitions = []*ConditionLinker{}
 	}
-	transitions = append(transitions, &ConditionLinker{exit: from, entry: to})
+	linker := &ConditionLinker{exit: from, entry: to}
+	transitions = append(transitions, linker)
+	o.linkers = append(o.linkers, linker)
 	stateEvents[from.event] = transitions
 	o.transitions[from.state.ID()] = stateEvents
 
@@ -61,46 +101,301 @@ func (o *StateMachine) Trans(from *StateExit, to StateEntry) {
 }
 
 func (o *StateMachine) Trigger(c context.Context, entity Entity, event Event) error {
+	_, err := o.trigger(c, entity, event)
+	return err
+}
+
+// trigger 返回事件执行的转换，事件延迟时为 nil
+func (o *StateMachine) trigger(c context.Context, entity Entity, event Event) (*Transition, error) {
 	state := entity.State()
-	stateEvents, stateExist := o.transitions[state.ID()]
-	if !stateExist {
-		return errors.New(fmt.Sprintf("%s 状态没有定义", state))
+	if err := cancelled(c, entity, state, event); err != nil {
+		return nil, err
 	}
-	transitions, eventExist := stateEvents[event]
-	if !eventExist {
-		return errors.New(fmt.Sprintf("%s - %v 事件没有定义", state, event))
+	// 加锁以前的检查只用来快速失败
+	if err := o.accepts(entity, state, event); err != nil {
+		return nil, err
 	}
 
-	// 支持并发控制
+	// 支持并发控制，等待锁的时候 ctx 结束返回 ErrCancelled
 	if o.lockerFactory != nil {
 		locker := o.lockerFactory.New(entity.ID())
-		locker.Lock()
+		if err := lockContext(c, locker); err != nil {
+			return nil, &TriggerError{Kind: ErrCancelled, EntityID: entity.ID(), State: state, Event: event, Cause: err}
+		}
 		defer locker.Unlock()
+
+		// 等待锁的时候其它 Trigger 可能已经更新了实体的状态
+		state = entity.State()
+		if err := o.accepts(entity, state, event); err != nil {
+			return nil, err
+		}
+	}
+
+	trans, state, err := o.dispatch(c, entity, state, event)
+	if err != nil {
+		return trans, err
 	}
+	o.redispatch(c, entity, state)
+	return trans, nil
+}
 
+// accepts 实体处于 state 时是否有事件的转换或者可以延迟事件，并发区域的事件在 fire 中检查
+func (o *StateMachine) accepts(entity Entity, state IState, event Event) error {
+	if _, parallel := state.(*Configuration); parallel {
+		return nil
+	}
+	if _, err := o.lookup(entity, state, event); err != nil && !o.deferrable(state, event) {
+		return err
+	}
+	return nil
+}
+
+// dispatch 执行事件的转换以及随后的完成转换，返回事件的转换和实体的新状态。
+// 没有处理并且可以延迟的事件保存到延迟队列中，转换为 nil，实体状态不变
+func (o *StateMachine) dispatch(c context.Context, entity Entity, state IState, event Event) (*Transition, IState, error) {
 	entity = o.filter.Before(c, entity, event)
 
+	trans, rejected, err := o.fire(c, entity, state, event, false)
+	if err != nil {
+		if (errors.Is(err, ErrUnknownState) || errors.Is(err, ErrUnknownEvent)) && o.deferrable(state, event) {
+			return nil, state, o.postpone(entity, state, event)
+		}
+		if executed(trans, err) {
+			_ = o.filter.After(c, entity, trans, err)
+		}
+		return trans, state, err
+	}
+	if err := o.commit(c, entity, state, event, trans, rejected); err != nil {
+		return trans, state, err
+	}
+	if trans.Internal {
+		return trans, trans.To, nil
+	}
+	state, err = o.complete(c, entity, trans.To)
+	return trans, state, err
+}
+
+// fire 选择并执行转换，返回的 Transition.To 为实体的新状态。
+// 实体处于 fork 的并发区域时，事件分发到每个区域，区域的转换在 Transition.Branches 中。
+// dry 为 true 时只检查条件，不执行任何动作
+func (o *StateMachine) fire(c context.Context, entity Entity, state IState, event Event, dry bool) (*Transition, []*Transition, error) {
+	if ps, ok := state.(*Configuration); ok {
+		return o.fireRegions(c, entity, ps, event, dry)
+	}
+
+	transitions, err := o.lookup(entity, state, event)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// 出 状态 条件判断
-	var transition *ConditionLinker
-	for _, trans := range transitions {
-		if trans.exit.cond(c, entity, trans.exit.state, trans.entry.State()) {
-			transition = trans
-			break
+	transition, failed := selectTransition(c, entity, transitions)
+	var rejected []*Transition
+	for _, trans := range failed {
+		if !dry {
+			log.Printf("%s：条件检查失败", trans.Text())
 		}
-		log.Printf("%s：条件检查失败", trans.Text())
+		rejected = append(rejected, trans.transition())
 	}
 	if transition == nil {
-		return errors.New(fmt.Sprintf("%s 所有事件检查均失败", state))
+		if err := cancelled(c, entity, state, event); err != nil {
+			return nil, rejected, err
+		}
+		return nil, rejected, &TriggerError{Kind: ErrNoGuardPassed, EntityID: entity.ID(), State: state, Event: event, Rejected: rejected}
+	}
+
+	if !dry {
+		if err := cancelled(c, entity, state, event); err != nil {
+			return nil, rejected, err
+		}
 	}
 
 	// 进 状态 操作逻辑
-	err := transition.entry.Action(c, entity, transition.exit.state, transition.entry.State())
+	trans := transition.transition()
+	from := transition.exit.state
+	target := transition.entry.State()
+	if history, ok := transition.entry.(*historyStateEntry); ok {
+		var cause error
+		if target, cause = history.resolve(c, entity); cause != nil {
+			return trans, rejected, &TriggerError{Kind: actionKind(c, cause), EntityID: entity.ID(), State: state, Event: event, Rejected: rejected, Cause: cause}
+		}
+		trans.To = target
+	}
+	if trans.Internal {
+		trans.To = state
+		if !dry {
+			if cause := transition.entry.Action(c, entity, from, target); cause != nil {
+				return trans, rejected, &TriggerError{Kind: actionKind(c, cause), EntityID: entity.ID(), State: state, Event: event, Rejected: rejected, Cause: cause}
+			}
+		}
+		return trans, rejected, nil
+	}
+	exited, entered := o.path(state, transition, target)
+	var cause error
+	if combo, ok := transition.entry.(*comboStateEntry); ok {
+		ps := combo.regions()
+		if !dry {
+			if cause = exitStates(c, entity, exited, combo.fork); cause == nil {
+				ps, cause = combo.enter(c, entity, from)
+			}
+		}
+		trans.To = ps
+		if cause == nil {
+			cause = join(c, entity, ps, trans, dry)
+		}
+	} else {
+		descent := descend(entered[len(entered)-1])
+		entered = append(entered, descent...)
+		if len(descent) > 0 {
+			trans.To = descent[len(descent)-1].state
+		}
+		// UML 顺序：离开源状态、转换动作、进入目标状态
+		if !dry {
+			cause = exitStates(c, entity, exited, trans.To)
+			if cause == nil {
+				cause = transition.entry.Action(c, entity, from, target)
+			}
+			if cause == nil {
+				cause = enterStates(c, entity, from, entered, len(descent))
+			}
+		}
+	}
+	trans.Exited, trans.Entered = states(exited), states(entered)
+	if cause != nil {
+		return trans, rejected, &TriggerError{Kind: actionKind(c, cause), EntityID: entity.ID(), State: state, Event: event, Rejected: rejected, Cause: cause}
+	}
+	return trans, rejected, nil
+}
 
-	o.filter.After(c, entity, &Transition{
-		From: transition.exit.state, Event: transition.exit.event, CondDesc: transition.exit.desc,
-		To: transition.entry.State(), ActionDesc: transition.entry.Desc(),
-	}, err)
-	return err
+func (o *StateMachine) fireRegions(c context.Context, entity Entity, ps *Configuration, event Event, dry bool) (*Transition, []*Transition, error) {
+	next := ps.copy()
+	trans := &Transition{From: ps, Event: event}
+	var rejected []*Transition
+	defined := false
+	for i, region := range ps.regions {
+		if region == nil {
+			continue
+		}
+		t, failed, err := machineOf(region, o).fire(c, entity, region, event, dry)
+		rejected = append(rejected, failed...)
+		switch {
+		case err == nil:
+			defined = true
+			next.regions[i] = t.To
+			trans.Branches = append(trans.Branches, t)
+		case errors.Is(err, ErrUnknownState) || errors.Is(err, ErrUnknownEvent):
+		case errors.Is(err, ErrNoGuardPassed):
+			defined = true
+		default:
+			return trans, rejected, err
+		}
+	}
+	if !defined {
+		return nil, rejected, &TriggerError{Kind: ErrUnknownEvent, EntityID: entity.ID(), State: ps, Event: event}
+	}
+	if len(trans.Branches) == 0 {
+		return nil, rejected, &TriggerError{Kind: ErrNoGuardPassed, EntityID: entity.ID(), State: ps, Event: event, Rejected: rejected}
+	}
+
+	trans.To = next
+	if cause := join(c, entity, next, trans, dry); cause != nil {
+		return trans, rejected, &TriggerError{Kind: actionKind(c, cause), EntityID: entity.ID(), State: ps, Event: event, Rejected: rejected, Cause: cause}
+	}
+	// 所有区域都是内部转换并且没有汇合时整体为内部转换
+	trans.Internal = trans.To == IState(next)
+	for _, t := range trans.Branches {
+		trans.Internal = trans.Internal && t.Internal
+	}
+	return trans, rejected, nil
+}
+
+// commit 更新实体状态，After、持久化失败时回滚
+func (o *StateMachine) commit(c context.Context, entity Entity, state IState, event Event, trans *Transition, rejected []*Transition) error {
+	mutable, _ := entity.(MutableEntity)
+	if mutable != nil {
+		mutable.SetState(trans.To)
+	}
+	cause := o.remember(c, entity, state, trans)
+	if cause == nil {
+		cause = o.filter.After(c, entity, trans, nil)
+	}
+	if cause == nil && mutable != nil && o.persister != nil {
+		cause = o.persister.Persist(c, mutable, trans)
+	}
+	if cause != nil {
+		if mutable != nil {
+			mutable.SetState(state)
+		}
+		return &TriggerError{Kind: ErrCommitFailed, EntityID: entity.ID(), State: state, Event: event, Rejected: rejected, Cause: cause}
+	}
+	if o.scheduler != nil {
+		o.scheduler.update(c, o, entity, trans.To, exitedLevels(trans, o))
+	}
+	return nil
+}
+
+// machineOf 状态所属的状态机，没有绑定时为 def
+func machineOf(s IState, def *StateMachine) *StateMachine {
+	if s.Machine() != nil {
+		return s.Machine()
+	}
+	return def
+}
+
+// lookup 从 state 开始逐级向外查找事件的转换，内层的转换排在前面。
+// 所有层都没有定义转换时返回 ErrUnknownState，都没有定义事件时返回 ErrUnknownEvent
+func (o *StateMachine) lookup(entity Entity, state IState, event Event) ([]*ConditionLinker, error) {
+	var transitions []*ConditionLinker
+	stateExist := false
+	for _, l := range levels(state, o) {
+		stateEvents, has := l.machine.transitions[l.state.ID()]
+		if !has {
+			continue
+		}
+		stateExist = true
+		transitions = append(transitions, stateEvents[event]...)
+	}
+	if !stateExist {
+		return nil, &TriggerError{Kind: ErrUnknownState, EntityID: entity.ID(), State: state, Event: event}
+	}
+	if len(transitions) == 0 {
+		return nil, &TriggerError{Kind: ErrUnknownEvent, EntityID: entity.ID(), State: state, Event: event}
+	}
+	return transitions, nil
+}
+
+// Simulation Trigger 的模拟结果。
+// Transition 为将要执行的转换，To、ActionDesc 为目标状态和动作，fork 的各个分支在 Branches 中；
+// Rejected 为条件检查失败的转换
+type Simulation struct {
+	Transition *Transition
+	Rejected   []*Transition
+}
+
+// Simulate 执行和 Trigger 相同的查找和条件检查，但是不执行任何 Action、Filter，也不加锁。
+// 失败时返回和 Trigger 相同的错误
+func (o *StateMachine) Simulate(c context.Context, entity Entity, event Event) (*Simulation, error) {
+	trans, rejected, err := o.fire(c, entity, entity.State(), event, true)
+	if errors.Is(err, ErrUnknownState) || errors.Is(err, ErrUnknownEvent) {
+		return nil, err
+	}
+	return &Simulation{Transition: trans, Rejected: rejected}, err
+}
+
+// selectTransition 按顺序检查条件，返回第一个通过的转换以及之前检查失败的转换
+func selectTransition(c context.Context, entity Entity, transitions []*ConditionLinker) (*ConditionLinker, []*ConditionLinker) {
+	var rejected []*ConditionLinker
+	for _, trans := range transitions {
+		// ctx 结束以后不再检查条件
+		if c.Err() != nil {
+			return nil, rejected
+		}
+		if trans.exit.cond(c, entity, trans.exit.state, trans.entry.State()) {
+			return trans, rejected
+		}
+		rejected = append(rejected, trans)
+	}
+	return nil, rejected
 }
 
 func (o *StateMachine) State(v interface{}) IState {
@@ -115,7 +410,11 @@ func (o *StateMachine) State(v interface{}) IState {
 func (o *StateMachine) Entry(s1 IState, desc string, action ...Action) StateEntry {
 	s1.Bind(o)
 	o.starts = append(o.starts, s1)
-	return s1.Entry(desc, action...)
+	entry := s1.Entry(desc, action...)
+	if o.initial == nil {
+		o.initial = entry
+	}
+	return entry
 }
 
 func (o *StateMachine) Exit(s1 IState, event Event, desc string, condition ...Condition) *StateExit {
@@ -124,15 +423,33 @@ func (o *StateMachine) Exit(s1 IState, event Event, desc string, condition ...Co
 	return s1.Exit(event, desc, condition...)
 }
 
+// OnEntry 从任何状态进入 s 时执行的动作，在转换的动作之后执行，动作中的 from 为转换的源状态
+func (o *StateMachine) OnEntry(s IState, actions ...Action) {
+	s.Bind(o)
+	if o.onEntry == nil {
+		o.onEntry = make(map[interface{}][]Action)
+	}
+	o.onEntry[s.ID()] = append(o.onEntry[s.ID()], actions...)
+}
+
+// OnExit 因为任何事件离开 s 时执行的动作，在转换的动作之前执行，动作中的 to 为转换的目标状态
+func (o *StateMachine) OnExit(s IState, actions ...Action) {
+	s.Bind(o)
+	if o.onExit == nil {
+		o.onExit = make(map[interface{}][]Action)
+	}
+	o.onExit[s.ID()] = append(o.onExit[s.ID()], actions...)
+}
+
 func (o *StateMachine) Fork(exit *StateExit) *ForkStateExit {
-	return &ForkStateExit{exit, o}
+	return &ForkStateExit{exit: exit, machine: o}
 }
 
-func (o *StateMachine) end(actions ...Action) StateEntry {
+func (o *StateMachine) end(desc string, actions ...Action) StateEntry {
 	return &normalStateEntry{
 		state:   o.State("[*]"),
 		actions: actions,
-		desc:    "end",
+		desc:    desc,
 	}
 }
 
@@ -205,6 +522,12 @@ func (o *StateMachine) Graph(steps map[*StateMachine]bool) (string, string) {
 		}
 	}
 
+	for stateID, events := range o.deferrals {
+		for _, event := range events {
+			transLines = append(transLines, fmt.Sprintf("%v : %v / defer", stateID, event))
+		}
+	}
+
 	for _, ss := range o.states {
 		if ss.ID() == "[*]" {
 			continue
@@ -215,6 +538,16 @@ func (o *StateMachine) Graph(steps map[*StateMachine]bool) (string, string) {
 			continue
 		}
 
+		// 组合状态
+		if sub := o.children[ss.ID()]; sub != nil {
+			m, line := sub.Graph(steps)
+			if m != "" {
+				stateLines = append(stateLines, fmt.Sprintf("    state \"%v\" as %v {\n%s\n    }", ss.ID(), ss.ID(), m))
+				transLines = append(transLines, line)
+				continue
+			}
+		}
+
 		stateLines = append(stateLines, fmt.Sprintf(`    state "%v" as %v`, ss.ID(), ss.ID()))
 	}
 	statesBuffer.WriteString(strings.Join(stateLines, "\n"))
@@ -231,17 +564,42 @@ func (o *StateMachine) Show() {
 }
 
 //---------------------------------------------------------------------------------
+// NewMachine 创建状态机并注册到注册表（默认 DefaultMachines），名字重复时替换已经注册的状态机。
+// 需要发现重复注册时使用 TryNewMachine，不需要注册时使用 Machines(nil)
 func NewMachine(name string, options ...Option) *StateMachine {
+	sm := newMachine(name, options...)
+	if sm.machines != nil {
+		sm.machines.put(sm)
+	}
+	return sm
+}
+
+// TryNewMachine 创建状态机并注册到注册表，名字重复时返回 *ErrDuplicateMachine
+func TryNewMachine(name string, options ...Option) (*StateMachine, error) {
+	sm := newMachine(name, options...)
+	if sm.machines != nil {
+		if err := sm.machines.Register(sm); err != nil {
+			return nil, err
+		}
+	}
+	return sm, nil
+}
+
+func newMachine(name string, options ...Option) *StateMachine {
 	sm := &StateMachine{
 		Name:        name,
 		transitions: make(map[interface{}]map[Event][]*ConditionLinker),
 		states:      make(map[interface{}]IState),
-		filter:      NoopFilter,
+		filter:      &uncheckedFilter{NoopFilter},
+		machines:    DefaultMachines,
+
+		completionLimit: DefaultCompletionLimit,
+		deferLimit:      DefaultDeferLimit,
+		workerQueue:     DefaultWorkerQueue,
 	}
 	for _, option := range options {
 		option(sm)
 	}
-	stateMachines[sm.Name] = sm
 	return sm
 }
 
@@ -254,7 +612,26 @@ func Locker(lockerFactory LockerFactory) Option {
 }
 
 func Aspect(filter Filter) Option {
+	return func(machine *StateMachine) {
+		machine.filter = &uncheckedFilter{filter}
+	}
+}
+
+func CheckedAspect(filter CheckedFilter) Option {
 	return func(machine *StateMachine) {
 		machine.filter = filter
 	}
 }
+
+func Persist(persister Persister) Option {
+	return func(machine *StateMachine) {
+		machine.persister = persister
+	}
+}
+
+// Machines 指定注册表，nil 表示不注册
+func Machines(registry *MachineRegistry) Option {
+	return func(machine *StateMachine) {
+		machine.machines = registry
+	}
+}
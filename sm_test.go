@@ -2,9 +2,13 @@ package gosm
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/threeq/goassert"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestStateMachine_Show(t *testing.T) {
@@ -86,3 +90,252 @@ func TestStateMachine_Trigger(t *testing.T) {
 	goassert.That(t, err).Equal(nil)
 	goassert.That(t, entity.s.ID()).Equal("s2")
 }
+
+// MutableTestEntity 实现 MutableEntity，状态机转换以后自动更新状态
+type MutableTestEntity struct {
+	TestEntity
+}
+
+func (t *MutableTestEntity) SetState(s IState) {
+	t.s = s
+}
+
+func NewMutableTestEntity(id string, s IState) *MutableTestEntity {
+	return &MutableTestEntity{TestEntity{id, s}}
+}
+
+type testPersister struct {
+	err   error
+	saved []interface{}
+}
+
+func (o *testPersister) Persist(ctx context.Context, entity MutableEntity, trans *Transition) error {
+	if o.err != nil {
+		return o.err
+	}
+	o.saved = append(o.saved, entity.State().ID())
+	return nil
+}
+
+type testCheckedFilter struct {
+	err error
+}
+
+func (o *testCheckedFilter) Before(ctx context.Context, entity Entity, event Event) Entity {
+	return entity
+}
+
+func (o *testCheckedFilter) After(ctx context.Context, entity Entity, trans *Transition, result error) error {
+	return o.err
+}
+
+// lockedTestEntity 状态的读写加锁，用于并发的测试
+type lockedTestEntity struct {
+	lock sync.Mutex
+	id   string
+	s    IState
+}
+
+func (t *lockedTestEntity) ID() string {
+	return t.id
+}
+
+func (t *lockedTestEntity) State() IState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.s
+}
+
+func (t *lockedTestEntity) SetState(s IState) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.s = s
+}
+
+func TestStateMachine_TriggerConcurrent(t *testing.T) {
+	var entered int32
+	sm := NewMachine("TestStateMachine_TriggerConcurrent", Machines(nil), Locker(&mutexLocker{}))
+	sm.Trans(State("s1").Exit("e1", ""), State("s2").Entry("", func(ctx context.Context, entity Entity, from, to IState) error {
+		atomic.AddInt32(&entered, 1)
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}))
+	sm.Trans(State("s2").Exit("e2", ""), State("s3").Entry(""))
+
+	entity := &lockedTestEntity{id: "1", s: State("s1")}
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- sm.Trigger(context.Background(), entity, "e1")
+		}()
+	}
+	var failed []error
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			failed = append(failed, err)
+		}
+	}
+	// 第二个 Trigger 获取锁以后看到 s2，不再执行 e1
+	goassert.That(t, atomic.LoadInt32(&entered)).Equal(int32(1))
+	goassert.That(t, len(failed)).Equal(1)
+	goassert.That(t, errors.Is(failed[0], ErrUnknownEvent)).Equal(true)
+	goassert.That(t, entity.State().ID()).Equal("s2")
+}
+
+func TestStateMachine_TriggerMutableEntity(t *testing.T) {
+	persister := &testPersister{}
+	filter := &testCheckedFilter{}
+	sm := NewMachine("TestStateMachine_TriggerMutableEntity", Machines(nil), Persist(persister), CheckedAspect(filter))
+	sm.Trans(State("s1").Exit("e1", ""), State("s2").Entry(""))
+	sm.Trans(State("s2").Exit("e2", ""), State("s3").Entry(""))
+
+	entity := NewMutableTestEntity("1", State("s1"))
+	err := sm.Trigger(context.Background(), entity, "e1")
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("s2")
+	goassert.That(t, persister.saved).Equal([]interface{}{"s2"})
+
+	persister.err = errors.New("persist")
+	err = sm.Trigger(context.Background(), entity, "e2")
+	goassert.That(t, errors.Is(err, ErrCommitFailed)).Equal(true)
+	goassert.That(t, errors.Is(err, persister.err)).Equal(true)
+	goassert.That(t, entity.s.ID()).Equal("s2")
+
+	persister.err = nil
+	filter.err = errors.New("after")
+	err = sm.Trigger(context.Background(), entity, "e2")
+	goassert.That(t, errors.Is(err, filter.err)).Equal(true)
+	goassert.That(t, entity.s.ID()).Equal("s2")
+	goassert.That(t, persister.saved).Equal([]interface{}{"s2"})
+
+	filter.err = nil
+	err = sm.Trigger(context.Background(), entity, "e2")
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("s3")
+}
+
+type countingLocker struct {
+	locks int
+}
+
+func (o *countingLocker) New(id string) sync.Locker {
+	return o
+}
+
+func (o *countingLocker) Lock() {
+	o.locks++
+}
+
+func (o *countingLocker) Unlock() {
+}
+
+func TestStateMachine_Simulate(t *testing.T) {
+	never := func(ctx context.Context, entity Entity, from, to IState) bool { return false }
+	executed := false
+	action := func(ctx context.Context, entity Entity, from, to IState) error {
+		executed = true
+		return nil
+	}
+	locker := &countingLocker{}
+	filter := &testCheckedFilter{err: errors.New("filter")}
+
+	sm := NewMachine("TestStateMachine_Simulate", Machines(nil), Locker(locker), CheckedAspect(filter))
+	sm.Trans(State("s1").Exit("e1", "never", never), State("s2").Entry("a2", action))
+	sm.Trans(State("s1").Exit("e1", "Any"), State("s3").Entry("a3", action))
+	sm.Trans(State("s1").Exit("e2", "never", never), State("s2").Entry("a2", action))
+	sm.Fork(State("s1").Exit("e3", "")).Link(Serial(All), State("s4").Entry("a4", action), State("s5").Entry("a5", action))
+
+	entity := NewMutableTestEntity("1", State("s1"))
+	simulation, err := sm.Simulate(context.Background(), entity, "e1")
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, simulation.Transition.To.ID()).Equal("s3")
+	goassert.That(t, simulation.Transition.ActionDesc).Equal("a3")
+	goassert.That(t, simulation.Rejected[0].To.ID()).Equal("s2")
+
+	simulation, err = sm.Simulate(context.Background(), entity, "e3")
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, len(simulation.Transition.Branches)).Equal(2)
+	goassert.That(t, simulation.Transition.Branches[1].ActionDesc).Equal("a5")
+
+	simulation, err = sm.Simulate(context.Background(), entity, "e2")
+	goassert.That(t, errors.Is(err, ErrNoGuardPassed)).Equal(true)
+	goassert.That(t, len(simulation.Rejected)).Equal(1)
+
+	_, err = sm.Simulate(context.Background(), entity, "e9")
+	goassert.That(t, errors.Is(err, ErrUnknownEvent)).Equal(true)
+
+	goassert.That(t, executed).Equal(false)
+	goassert.That(t, locker.locks).Equal(0)
+	goassert.That(t, entity.s.ID()).Equal("s1")
+}
+
+func TestStateMachine_OnEntry(t *testing.T) {
+	var steps []string
+	record := func(step string) Action {
+		return func(ctx context.Context, entity Entity, from, to IState) error {
+			steps = append(steps, fmt.Sprintf("%s %v->%v", step, from.ID(), to.ID()))
+			return nil
+		}
+	}
+	failed := errors.New("failed")
+
+	sm := NewMachine("TestStateMachine_OnEntry", Machines(nil))
+	sm.Trans(State("s1").Exit("e1", ""), State("s2").Entry("", record("trans")))
+	sm.Trans(State("s2").Exit("e2", ""), State("s3").Entry("", record("trans")))
+	sm.Fork(State("s3").Exit("e3", "")).
+		Link(Serial(All), State("r1").Entry(""), State("r2").Entry("")).
+		Join("", State("r1"), State("r2")).
+		Link(State("s4").Entry("", record("join")))
+	sm.OnExit(State("s1"), record("exit"))
+	sm.OnEntry(State("s2"), record("entry"), record("entry"))
+	sm.OnExit(State("s2"), func(ctx context.Context, entity Entity, from, to IState) error {
+		return failed
+	})
+	sm.OnEntry(State("r1"), record("entry"))
+	sm.OnExit(State("r2"), record("exit"))
+	sm.OnEntry(State("s4"), record("entry"))
+
+	entity := NewMutableTestEntity("1", State("s1"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e1")).Equal(nil)
+	goassert.That(t, steps).Equal([]string{"exit s1->s2", "trans s1->s2", "entry s1->s2", "entry s1->s2"})
+
+	err := sm.Trigger(context.Background(), entity, "e2")
+	goassert.That(t, errors.Is(err, ErrActionFailed)).Equal(true)
+	goassert.That(t, errors.Is(err, failed)).Equal(true)
+	goassert.That(t, entity.s.ID()).Equal("s2")
+	goassert.That(t, len(steps)).Equal(4)
+
+	steps = nil
+	entity = NewMutableTestEntity("2", State("s3"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "e3")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("s4")
+	goassert.That(t, steps).Equal([]string{"entry s3->r1", "exit r2->s4", "join s3_e3_join->s4", "entry s3_e3_join->s4"})
+}
+
+func TestStateMachine_OnEntryCompose(t *testing.T) {
+	var records []string
+	express := false
+	sm := hsmMachine("TestStateMachine_OnEntryCompose", &records, &express)
+	processing := sm.Child(sm.State("processing"))
+	packing := processing.Child(processing.State("packing"))
+	record := func(name string) Action {
+		return func(ctx context.Context, entity Entity, from, to IState) error {
+			records = append(records, name)
+			return nil
+		}
+	}
+	sm.OnEntry(sm.State("processing"), record("entry processing"))
+	sm.OnExit(sm.State("processing"), record("exit processing"))
+	processing.OnEntry(processing.State("picking"), record("entry picking"))
+	packing.OnExit(packing.State("boxing"), record("exit boxing"))
+	processing.OnExit(processing.State("packing"), record("exit packing"))
+
+	entity := NewMutableTestEntity("1", State("created"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, records).Equal([]string{"pay", "entry processing", "init picking", "entry picking"})
+
+	records = nil
+	entity = NewMutableTestEntity("2", packing.State("boxing"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "cancel")).Equal(nil)
+	goassert.That(t, records).Equal([]string{"exit boxing", "exit packing", "exit processing", "cancel"})
+}
@@ -7,7 +7,6 @@ import (
 	"log"
 	"strings"
 	"sync"
-	"sync/atomic"
 )
 
 type SuccessStrategy = func(ctx context.Context, entity Entity, from IState, stateEntries []StateEntry) (func() error, func(err error) bool)
@@ -16,28 +15,93 @@ type Executor = func(ctx context.Context, entity Entity, from IState, stateEntri
 type ForkStateExit struct {
 	exit    *StateExit
 	machine *StateMachine
+	desc    string
 }
 
-func (o *ForkStateExit) Link(executor Executor, stateEntries ...StateEntry) {
+// Desc 执行器的名字，序列化状态机时使用
+func (o *ForkStateExit) Desc(desc string) *ForkStateExit {
+	o.desc = desc
+	return o
+}
+
+// Link 每个分支是一个并发区域，返回的 Fork 用来声明 Join
+func (o *ForkStateExit) Link(executor Executor, stateEntries ...StateEntry) *Fork {
+	forkID := fmt.Sprintf("%v_%v_fork", o.exit.state.ID(), o.exit.event)
+	fork := State(forkID, "fork")
+	fork.Bind(o.machine)
+
 	entry := &comboStateEntry{
 		machine:      o.machine,
+		fork:         fork,
 		stateEntries: stateEntries,
 		executor:     executor,
+		desc:         o.desc,
 	}
-	forkID := fmt.Sprintf("%v_%v_fork", o.exit.state.ID(), o.exit.event)
-	fork := State(forkID, "fork")
-	fork.Bind(o.machine)
-
 	o.machine.Trans(o.exit, entry)
+	return &Fork{entry: entry}
 }
 
 type comboStateEntry struct {
 	state        IState
 	machine      *StateMachine
+	fork         IState
 	action       Action
 	desc         string
 	stateEntries []StateEntry
 	executor     Executor
+	join         *Join
+}
+
+// enter 执行所有分支，进入成功的分支成为活动区域
+func (o *comboStateEntry) enter(ctx context.Context, entity Entity, from IState) (*Configuration, error) {
+	lock := &sync.Mutex{}
+	closed := false
+	regions := make([]IState, len(o.stateEntries))
+	entries := make([]StateEntry, len(o.stateEntries))
+	for i, entry := range o.stateEntries {
+		i, entry := i, entry
+		entries[i] = &regionStateEntry{StateEntry: entry, machine: machineOf(entry.State(), o.machine), entered: func() {
+			lock.Lock()
+			defer lock.Unlock()
+			if !closed {
+				regions[i] = entry.State()
+			}
+		}}
+	}
+
+	err := o.executor(ctx, entity, from, entries)
+
+	// 快速返回的策略可能还有分支在执行，之后完成的分支不再进入
+	lock.Lock()
+	defer lock.Unlock()
+	closed = true
+	return &Configuration{fork: o, regions: append([]IState(nil), regions...)}, err
+}
+
+// regions 不执行分支，假设所有分支都进入成功
+func (o *comboStateEntry) regions() *Configuration {
+	ps := &Configuration{fork: o}
+	for _, entry := range o.stateEntries {
+		ps.regions = append(ps.regions, entry.State())
+	}
+	return ps
+}
+
+type regionStateEntry struct {
+	StateEntry
+	machine *StateMachine
+	entered func()
+}
+
+func (o *regionStateEntry) Action(ctx context.Context, entity Entity, from, to IState) error {
+	err := o.StateEntry.Action(ctx, entity, from, to)
+	if err == nil {
+		err = enterStates(ctx, entity, from, []level{{state: to, machine: o.machine}}, 0)
+	}
+	if err == nil {
+		o.entered()
+	}
+	return err
 }
 
 func (o *comboStateEntry) State() IState {
@@ -56,11 +120,15 @@ func (o *comboStateEntry) Desc() string {
 }
 
 func (o *comboStateEntry) Graph(exit *StateExit) (string, string) {
+	var lines []string
+	var machines []string
 	if len(o.stateEntries) == 1 {
-		return o.stateEntries[0].Graph(exit)
+		m, line := o.stateEntries[0].Graph(exit)
+		if m != "" {
+			machines = append(machines, m)
+		}
+		lines = append(lines, line)
 	} else {
-		var lines []string
-		var machines []string
 		forkID := fmt.Sprintf("%v_%v_fork", exit.state.ID(), exit.event)
 		fork := State(forkID)
 		m, line := fork.Entry("").Graph(exit)
@@ -76,14 +144,25 @@ func (o *comboStateEntry) Graph(exit *StateExit) (string, string) {
 			}
 			lines = append(lines, line)
 		}
-		return strings.Join(machines, "\n"), strings.Join(lines, "\n")
 	}
+	if o.join != nil {
+		m, line := o.join.Graph()
+		if m != "" {
+			machines = append(machines, m)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(machines, "\n"), strings.Join(lines, "\n")
 }
 
 func Serial(successStrategy SuccessStrategy) Executor {
 	return func(ctx context.Context, entity Entity, from IState, stateEntries []StateEntry) error {
 		wait, checker := successStrategy(ctx, entity, from, stateEntries)
 		for _, entry := range stateEntries {
+			// ctx 结束以后不再执行剩余的分支
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			err := entry.Action(ctx, entity, from, entry.State())
 			stop := checker(err)
 			if stop {
@@ -96,10 +175,17 @@ func Serial(successStrategy SuccessStrategy) Executor {
 
 func Parallel(successStrategy SuccessStrategy) Executor {
 	return func(ctx context.Context, entity Entity, from IState, stateEntries []StateEntry) error {
+		// 策略已经有结果（或者 ctx 结束）以后，通知还在执行的分支取消
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
 		wait, checker := successStrategy(ctx, entity, from, stateEntries)
 		for _, entry := range stateEntries {
 			go func(entry StateEntry) {
-				//FIXME 思考是否需要前置检测
+				// ctx 结束以后还没有开始的分支不再执行
+				if err := ctx.Err(); err != nil {
+					_ = checker(err)
+					return
+				}
 				err := entry.Action(ctx, entity, from, entry.State())
 				_ = checker(err)
 			}(entry)
@@ -108,41 +194,81 @@ func Parallel(successStrategy SuccessStrategy) Executor {
 	}
 }
 
-//OneFast 快速成功。成功以后的 entry 不会触发
-func OneFast(ctx context.Context, entity Entity, from IState, stateEntries []StateEntry) (func() error, func(err error) bool) {
+// branchResults 成功策略统计的分支结果，分支可能并发完成。
+// 满足策略的条件以后调用 finish，waiter 返回；ctx 先结束时 waiter 返回 ctx.Err()
+type branchResults struct {
+	lock    sync.Mutex
+	once    sync.Once
+	done    chan struct{}
+	total   int
+	success int
+	failed  int
+	err     error
+}
+
+func newBranchResults(total int) *branchResults {
+	results := &branchResults{done: make(chan struct{}), total: total}
+	if total == 0 {
+		results.finish()
+	}
+	return results
+}
+
+func (o *branchResults) finish() {
+	o.once.Do(func() {
+		close(o.done)
+	})
+}
+
+func (o *branchResults) wait(ctx context.Context, result func() error) error {
+	select {
+	case <-o.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return result()
+}
 
-	wait := &sync.WaitGroup{}
-	wait.Add(1)
-	once := &sync.Once{}
+// add 记录一个分支的结果，返回所有分支是否都已经完成
+func (o *branchResults) add(err error) bool {
+	if err != nil {
+		o.failed++
+		o.err = err
+	} else {
+		o.success++
+	}
+	return o.success+o.failed == o.total
+}
 
-	var total = int32(len(stateEntries))
-	var errCount = int32(0)
+//OneFast 快速成功。成功以后的 entry 不会触发
+func OneFast(ctx context.Context, entity Entity, from IState, stateEntries []StateEntry) (func() error, func(err error) bool) {
+	results := newBranchResults(len(stateEntries))
 
 	var waiter = func() error {
-		wait.Wait()
-		if errCount == total {
-			return errors.New("全部错误")
-		}
-		return nil
+		return results.wait(ctx, func() error {
+			if results.failed == results.total {
+				return errors.New("全部错误")
+			}
+			return nil
+		})
 	}
 
 	var checker = func(err error) bool {
+		results.lock.Lock()
+		defer results.lock.Unlock()
 		if err == nil {
-			once.Do(func() {
-				wait.Done()
-			})
+			results.add(err)
+			results.finish()
 			return true
 		}
 
 		//FIXME 错误处理
 		log.Printf("%v", err)
-		atomic.AddInt32(&errCount, 1)
-		if atomic.LoadInt32(&errCount) == total {
-			once.Do(func() {
-				wait.Done()
-			})
+		if results.add(err) {
+			results.finish()
 		}
-
 		return false
 	}
 
@@ -151,27 +277,27 @@ func OneFast(ctx context.Context, entity Entity, from IState, stateEntries []Sta
 
 //One 所有 entry 都会触发
 func One(ctx context.Context, entity Entity, from IState, stateEntries []StateEntry) (func() error, func(err error) bool) {
+	results := newBranchResults(len(stateEntries))
 
-	wait := &sync.WaitGroup{}
-	wait.Add(len(stateEntries))
-	var success = false
 	var waiter = func() error {
-		wait.Wait()
-		if success {
-			return nil
-		}
-		return errors.New("全部错误")
+		return results.wait(ctx, func() error {
+			if results.success > 0 {
+				return nil
+			}
+			return errors.New("全部错误")
+		})
 	}
 
 	var checker = func(err error) bool {
-		if err == nil {
-			success = true
-		}
 		//FIXME 错误处理
 		if err != nil {
 			log.Printf("%v", err)
 		}
-		wait.Done()
+		results.lock.Lock()
+		defer results.lock.Unlock()
+		if results.add(err) {
+			results.finish()
+		}
 		return false
 	}
 
@@ -180,33 +306,27 @@ func One(ctx context.Context, entity Entity, from IState, stateEntries []StateEn
 
 //AllFast 快速失败。失败以后的 entry 不会触发
 func AllFast(ctx context.Context, entity Entity, from IState, stateEntries []StateEntry) (func() error, func(err error) bool) {
-	wait := &sync.WaitGroup{}
-	wait.Add(1)
-	once := &sync.Once{}
-
-	var total = int32(len(stateEntries))
-	var okCount = int32(0)
-	var hasErr error
+	results := newBranchResults(len(stateEntries))
 
 	var waiter = func() error {
-		wait.Wait()
-		return hasErr
+		return results.wait(ctx, func() error {
+			return results.err
+		})
 	}
 
 	var checker = func(err error) bool {
+		results.lock.Lock()
+		defer results.lock.Unlock()
 		if err != nil {
-			hasErr = err
 			log.Printf("%v", err)
-			once.Do(func() {
-				wait.Done()
-			})
+			if results.err == nil {
+				results.add(err)
+			}
+			results.finish()
 			return true
 		}
-		atomic.AddInt32(&okCount, 1)
-		if atomic.LoadInt32(&okCount) == total {
-			once.Do(func() {
-				wait.Done()
-			})
+		if results.add(err) {
+			results.finish()
 		}
 		return false
 	}
@@ -216,37 +336,38 @@ func AllFast(ctx context.Context, entity Entity, from IState, stateEntries []Sta
 
 //All 所有 entry 都会触发
 func All(ctx context.Context, entity Entity, from IState, stateEntries []StateEntry) (func() error, func(err error) bool) {
-	wait := &sync.WaitGroup{}
-	wait.Add(len(stateEntries))
-
-	hasErr := false
+	results := newBranchResults(len(stateEntries))
 
 	var waiter = func() error {
-		wait.Wait()
-		if hasErr {
-			return errors.New("存在部分错误")
-		}
-		return nil
+		return results.wait(ctx, func() error {
+			if results.failed > 0 {
+				return errors.New("存在部分错误")
+			}
+			return nil
+		})
 	}
 
 	var checker = func(err error) bool {
 		//FIXME 错误处理
 		if err != nil {
-			hasErr = true
 			log.Printf("%v", err)
 		}
-		wait.Done()
+		results.lock.Lock()
+		defer results.lock.Unlock()
+		if results.add(err) {
+			results.finish()
+		}
 		return false
 	}
 
 	return waiter, checker
 }
 
-//Always 始终正常，保证触发所有 entry
+//Always 始终正常，保证触发所有 entry，ctx 结束时返回 ctx.Err()
 func Always(ctx context.Context, entity Entity, from IState, stateEntries []StateEntry) (func() error, func(err error) bool) {
 
 	var waiter = func() error {
-		return nil
+		return ctx.Err()
 	}
 
 	var checker = func(err error) bool {
@@ -0,0 +1,127 @@
+package gosm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Fork fork 产生的并发区域，每个分支是一个区域
+type Fork struct {
+	entry *comboStateEntry
+}
+
+// Join 声明汇合伪状态：区域当前状态属于 finals（或者 [*]）时区域完成，
+// 完成的区域数量达到 Quorum（默认为全部活动区域）时执行 Join 的转换
+func (o *Fork) Join(desc string, finals ...IState) *Join {
+	fork := o.entry.fork
+	join := State(strings.TrimSuffix(fmt.Sprint(fork.ID()), "_fork")+"_join", "join")
+	join.Bind(o.entry.machine)
+
+	o.entry.join = &Join{state: join, fork: o.entry, finals: finals, desc: desc}
+	return o.entry.join
+}
+
+type Join struct {
+	state  IState
+	fork   *comboStateEntry
+	finals []IState
+	quorum int
+	desc   string
+	entry  StateEntry
+}
+
+// Quorum 需要完成的区域数量，小于等于 0 表示全部活动区域
+func (o *Join) Quorum(n int) *Join {
+	o.quorum = n
+	return o
+}
+
+// Link 所有区域完成以后进入的状态
+func (o *Join) Link(entry StateEntry) {
+	o.entry = entry
+}
+
+func (o *Join) final(s IState) bool {
+	if s.ID() == "[*]" {
+		return true
+	}
+	for _, f := range o.finals {
+		if f.ID() == s.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+// ready 完成的区域数量是否达到 quorum
+func (o *Join) ready(ps *Configuration) bool {
+	if o.entry == nil {
+		return false
+	}
+	active, done := 0, 0
+	for _, region := range ps.regions {
+		if region == nil {
+			continue
+		}
+		active++
+		if o.final(region) {
+			done++
+		}
+	}
+	if active == 0 {
+		return false
+	}
+	quorum := o.quorum
+	if quorum <= 0 || quorum > active {
+		quorum = active
+	}
+	return done >= quorum
+}
+
+func (o *Join) Graph() (string, string) {
+	var lines []string
+	for _, f := range o.finals {
+		lines = append(lines, fmt.Sprintf("%v --> %v", f.ID(), o.state.ID()))
+	}
+	desc := o.desc
+	if o.quorum > 0 {
+		desc = fmt.Sprintf("%s quorum=%d", desc, o.quorum)
+	}
+	if o.entry == nil {
+		return "", strings.Join(lines, "\n")
+	}
+	m, line := o.entry.Graph(o.state.Exit("join", desc, Any))
+	lines = append(lines, line)
+	return m, strings.Join(lines, "\n")
+}
+
+//---------------------------------------------------------------------------------
+
+// join 汇合条件满足时执行 Join 的转换，并把 trans.To 更新为 Join 的目标状态
+func join(c context.Context, entity Entity, ps *Configuration, trans *Transition, dry bool) error {
+	join := ps.fork.join
+	if join == nil || !join.ready(ps) {
+		return nil
+	}
+	if !dry {
+		var exited []level
+		for _, region := range ps.regions {
+			if region != nil {
+				exited = append(exited, level{state: region, machine: machineOf(region, ps.fork.machine)})
+			}
+		}
+		to := join.entry.State()
+		if err := exitStates(c, entity, exited, to); err != nil {
+			return err
+		}
+		if err := join.entry.Action(c, entity, join.state, to); err != nil {
+			return err
+		}
+		if err := enterStates(c, entity, join.state, []level{{state: to, machine: machineOf(to, ps.fork.machine)}}, 0); err != nil {
+			return err
+		}
+	}
+	trans.To = join.entry.State()
+	return nil
+}
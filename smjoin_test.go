@@ -0,0 +1,108 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"testing"
+)
+
+func joinMachine(name string, quorum int, branchErr error) *StateMachine {
+	packing := Noop
+	if branchErr != nil {
+		packing = func(ctx context.Context, entity Entity, from, to IState) error {
+			return branchErr
+		}
+	}
+	sm := NewMachine(name, Machines(nil))
+	sm.Fork(State("created").Exit("pay", "")).
+		Desc("serial,always").
+		Link(Serial(Always),
+			State("pending").Entry("", Noop),
+			State("packing").Entry("", packing)).
+		Join("", State("done"), State("shipped")).Quorum(quorum).
+		Link(State("completed").Entry(""))
+	sm.Trans(State("pending").Exit("confirm", ""), State("done").Entry(""))
+	sm.Trans(State("packing").Exit("ship", ""), State("shipped").Entry(""))
+	sm.Trans(State("packing").Exit("confirm", ""), State("packed").Entry(""))
+	sm.Trans(State("completed").Exit("close", ""), State("closed").Entry(""))
+	return sm
+}
+
+func TestStateMachine_TriggerJoin(t *testing.T) {
+	sm := joinMachine("TestStateMachine_TriggerJoin", 0, nil)
+	sm.Show()
+
+	entity := NewMutableTestEntity("1", State("created"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("created_pay_fork(pending|packing)")
+
+	err := sm.Trigger(context.Background(), entity, "close")
+	goassert.That(t, errors.Is(err, ErrUnknownEvent)).Equal(true)
+
+	events, err := sm.AvailableEvents(context.Background(), entity)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, len(events)).Equal(2)
+	goassert.That(t, events[0].Event).Equal("confirm")
+	goassert.That(t, len(events[0].Passed.Branches)).Equal(2)
+
+	// 两个区域同时处理
+	goassert.That(t, sm.Trigger(context.Background(), entity, "confirm")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("created_pay_fork(done|packed)")
+
+	entity = NewMutableTestEntity("2", State("created"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "ship")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("created_pay_fork(pending|shipped)")
+
+	simulation, err := sm.Simulate(context.Background(), entity, "confirm")
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, simulation.Transition.To.ID()).Equal("completed")
+	goassert.That(t, entity.s.ID()).Equal("created_pay_fork(pending|shipped)")
+
+	goassert.That(t, sm.Trigger(context.Background(), entity, "confirm")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("completed")
+	goassert.That(t, sm.Trigger(context.Background(), entity, "close")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("closed")
+}
+
+func TestStateMachine_TriggerJoinQuorum(t *testing.T) {
+	sm := joinMachine("TestStateMachine_TriggerJoinQuorum", 1, nil)
+	entity := NewMutableTestEntity("1", State("created"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "ship")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("completed")
+}
+
+func TestStateMachine_TriggerJoinFailedRegion(t *testing.T) {
+	sm := joinMachine("TestStateMachine_TriggerJoinFailedRegion", 0, errors.New("packing"))
+	entity := NewMutableTestEntity("1", State("created"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("created_pay_fork(pending)")
+
+	err := sm.Trigger(context.Background(), entity, "ship")
+	goassert.That(t, errors.Is(err, ErrUnknownEvent)).Equal(true)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "confirm")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("completed")
+}
+
+func TestMarshal_Join(t *testing.T) {
+	sm := joinMachine("TestMarshal_Join", 1, nil)
+	data, err := Marshal(sm, YAML)
+	goassert.That(t, err).Equal(nil)
+
+	registry := NewMachineRegistry()
+	builder := NewBuilder().Machines(registry)
+	goassert.That(t, builder.Load(data, YAML)).Equal(nil)
+	loaded := builder.Build("TestMarshal_Join")
+
+	again, err := Marshal(loaded, YAML)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, string(again)).Equal(string(data))
+	goassert.That(t, len(loaded.Validate().Errors())).Equal(0)
+
+	entity := NewMutableTestEntity("1", State("created"))
+	goassert.That(t, loaded.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, loaded.Trigger(context.Background(), entity, "confirm")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("completed")
+}
@@ -36,6 +36,12 @@ type state struct {
 	machine    *StateMachine
 }
 
+// isPseudoState choice、fork、join、history 是展示和执行时生成的伪状态
+func isPseudoState(s IState) bool {
+	ss, ok := s.(*state)
+	return ok && (ss.stereotype == "choice" || ss.stereotype == "fork" || ss.stereotype == "join" || ss.stereotype == "history")
+}
+
 func (o *state) ID() interface{} {
 	return o.value
 }
@@ -131,7 +137,7 @@ type StateExit struct {
 }
 
 func (o *StateExit) End(actions ...Action) {
-	o.state.Machine().Trans(o, o.state.Machine().end(actions...))
+	o.state.Machine().Trans(o, o.state.Machine().end("end", actions...))
 }
 
 func (o *StateExit) Link(entry StateEntry) {
@@ -149,6 +155,23 @@ func (o *ConditionLinker) Text() string {
 		o.exit.state.ID(), o.exit.event, o.exit.desc, o.entry.State().ID())
 }
 
+func (o *ConditionLinker) transition() *Transition {
+	trans := &Transition{
+		From: o.exit.state, Event: o.exit.event, Cond: o.exit.cond, CondDesc: o.exit.desc,
+		To: o.entry.State(), Action: o.entry.Action, ActionDesc: o.entry.Desc(),
+	}
+	_, trans.Internal = o.entry.(*internalStateEntry)
+	if combo, ok := o.entry.(*comboStateEntry); ok {
+		for _, entry := range combo.stateEntries {
+			trans.Branches = append(trans.Branches, &Transition{
+				From: o.exit.state, Event: o.exit.event, Cond: o.exit.cond, CondDesc: o.exit.desc,
+				To: entry.State(), Action: entry.Action, ActionDesc: entry.Desc(),
+			})
+		}
+	}
+	return trans
+}
+
 func (o *ConditionLinker) Graph(exit ...*StateExit) (string, string) {
 	e := o.exit
 	if len(exit) > 0 {
@@ -162,3 +185,9 @@ type Entity interface {
 	ID() string
 	State() IState
 }
+
+// MutableEntity 进入状态的动作执行成功以后，状态机自动调用 SetState 更新实体状态
+type MutableEntity interface {
+	Entity
+	SetState(state IState)
+}
@@ -0,0 +1,473 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TimeoutEvent 定时转换的事件，计时结束时 Scheduler 使用这个事件调用 Trigger
+type TimeoutEvent struct {
+	State interface{}
+	Desc  string
+}
+
+func (o TimeoutEvent) String() string {
+	return o.Desc
+}
+
+type timer struct {
+	event    TimeoutEvent
+	after    time.Duration
+	deadline func(ctx context.Context, entity Entity) time.Time
+}
+
+// After 实体在状态 s 停留 d 以后触发的转换，离开 s 时取消计时。desc、condition 和 IState.Exit 相同。
+// 需要使用 Timers 设置 Scheduler
+//
+//	sm.After(sm.State("created"), 30*time.Minute, "").Link(sm.State("cancelled").Entry(""))
+func (o *StateMachine) After(s IState, d time.Duration, desc string, condition ...Condition) *StateExit {
+	t := &timer{event: TimeoutEvent{State: s.ID(), Desc: fmt.Sprintf("after(%v)", d)}, after: d}
+	return o.timer(s, t, desc, condition)
+}
+
+// At 实体进入状态 s 时使用 deadline 计算触发时间，到达时间时触发的转换，离开 s 时取消计时
+func (o *StateMachine) At(s IState, deadline func(ctx context.Context, entity Entity) time.Time, desc string, condition ...Condition) *StateExit {
+	t := &timer{event: TimeoutEvent{State: s.ID(), Desc: fmt.Sprintf("at#%d", len(o.timers[s.ID()])+1)}, deadline: deadline}
+	return o.timer(s, t, desc, condition)
+}
+
+func (o *StateMachine) timer(s IState, t *timer, desc string, condition []Condition) *StateExit {
+	s.Bind(o)
+	if o.timers == nil {
+		o.timers = make(map[interface{}][]*timer)
+	}
+	o.timers[s.ID()] = append(o.timers[s.ID()], t)
+	return s.Exit(t.event, desc, condition...)
+}
+
+// Timers 设置执行定时转换的 Scheduler
+func Timers(scheduler *Scheduler) Option {
+	return func(machine *StateMachine) {
+		machine.scheduler = scheduler
+	}
+}
+
+// ScheduleTimers 按照实体的当前状态开始计时，用于新创建的实体。已经开始的计时保持不变
+func (o *StateMachine) ScheduleTimers(c context.Context, entity Entity) {
+	if o.scheduler != nil {
+		o.scheduler.update(c, o, entity, entity.State(), nil)
+	}
+}
+
+//---------------------------------------------------------------------------------
+
+// Clock 时钟，测试时可以使用 ManualClock
+type Clock interface {
+	Now() time.Time
+	// AfterFunc d 以后在其它 goroutine 中执行 f，返回的 stop 用来取消
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// ManualClock 手动调整时间的时钟，Advance 时在当前 goroutine 中按照时间顺序执行到期的函数
+type ManualClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	seq     int
+	pending map[int]*manualTimer
+}
+
+type manualTimer struct {
+	seq int
+	at  time.Time
+	f   func()
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now, pending: make(map[int]*manualTimer)}
+}
+
+func (o *ManualClock) Now() time.Time {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.now
+}
+
+func (o *ManualClock) AfterFunc(d time.Duration, f func()) func() bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.seq++
+	seq := o.seq
+	o.pending[seq] = &manualTimer{seq: seq, at: o.now.Add(d), f: f}
+	return func() bool {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		_, has := o.pending[seq]
+		delete(o.pending, seq)
+		return has
+	}
+}
+
+// Advance 时间前进 d
+func (o *ManualClock) Advance(d time.Duration) {
+	o.lock.Lock()
+	end := o.now.Add(d)
+	o.lock.Unlock()
+	for {
+		o.lock.Lock()
+		var next *manualTimer
+		for _, t := range o.pending {
+			if !t.at.After(end) && (next == nil || t.at.Before(next.at) || (t.at.Equal(next.at) && t.seq < next.seq)) {
+				next = t
+			}
+		}
+		if next == nil {
+			o.now = end
+			o.lock.Unlock()
+			return
+		}
+		delete(o.pending, next.seq)
+		o.now = next.at
+		o.lock.Unlock()
+		next.f()
+	}
+}
+
+//---------------------------------------------------------------------------------
+
+// Scheduler 执行定时转换：Trigger 提交成功以后，为实体新进入的状态开始计时，取消已经离开的状态的计时；
+// 计时结束时使用 TimeoutEvent 调用 Trigger。
+// 设置 Store 以后计时保存在 TimerStore 中，重启以后使用 Restore 恢复。触发保证至少一次：
+// Trigger 返回 ErrActionFailed、ErrCommitFailed 或者加载实体失败时，RetryDelay 以后使用相同的幂等键重试
+type Scheduler struct {
+	clock Clock
+	store TimerStore
+	lock  sync.Mutex
+	jobs  map[timerKey]map[TimeoutEvent]*timerJob
+	// OnError 定时触发失败时调用，默认打印日志
+	OnError func(entityID string, event Event, err error)
+	// Loader 触发时加载实体，没有设置时使用开始计时时的实体。Restore 恢复的计时必须设置
+	Loader func(ctx context.Context, machine *StateMachine, entityID string) (Entity, error)
+	// RetryDelay 重试的间隔，默认 1 分钟
+	RetryDelay time.Duration
+}
+
+type timerKey struct {
+	machine  *StateMachine
+	entityID string
+}
+
+type timerJob struct {
+	level  level
+	record *TimerRecord
+	entity Entity
+	stop   func() bool
+}
+
+func NewScheduler(clock Clock) *Scheduler {
+	if clock == nil {
+		clock = SystemClock
+	}
+	return &Scheduler{
+		clock: clock,
+		jobs:  make(map[timerKey]map[TimeoutEvent]*timerJob),
+		OnError: func(entityID string, event Event, err error) {
+			log.Printf("[%s] 定时事件 %v 触发失败: %v", entityID, event, err)
+		},
+		RetryDelay: time.Minute,
+	}
+}
+
+// Store 设置保存计时的 TimerStore
+func (o *Scheduler) Store(store TimerStore) *Scheduler {
+	o.store = store
+	return o
+}
+
+// Pending 实体正在计时的事件以及触发时间，按照时间排序
+func (o *Scheduler) Pending(machine *StateMachine, entityID string) []*PendingTimer {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var timers []*PendingTimer
+	for event, job := range o.jobs[timerKey{machine, entityID}] {
+		timers = append(timers, &PendingTimer{Event: event, At: job.record.At, Key: job.record.Key})
+	}
+	sort.Slice(timers, func(i, j int) bool {
+		return timers[i].At.Before(timers[j].At)
+	})
+	return timers
+}
+
+type PendingTimer struct {
+	Event TimeoutEvent
+	At    time.Time
+	Key   string
+}
+
+// Restore 从 TimerStore 中恢复 machine 的计时，已经到期的计时立即触发
+func (o *Scheduler) Restore(c context.Context, machine *StateMachine) error {
+	if o.store == nil || o.Loader == nil {
+		return errors.New("恢复计时需要设置 Store 和 Loader")
+	}
+	records, err := o.store.List(c)
+	if err != nil {
+		return err
+	}
+	owners := map[string]*StateMachine{machine.Name: machine}
+	for _, sm := range machine.Submachines() {
+		owners[sm.Name] = sm
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, record := range records {
+		if record.Machine != machine.Name {
+			continue
+		}
+		l, t := o.lookup(owners[record.Owner], record)
+		if t == nil {
+			log.Printf("[%s] 定时事件 %s/%s/%s 没有定义，删除", record.EntityID, record.Owner, record.State, record.Event)
+			if err := o.store.Delete(c, record.Key); err != nil {
+				return err
+			}
+			continue
+		}
+		jobs := o.entityJobs(timerKey{machine, record.EntityID})
+		if _, has := jobs[t.event]; !has {
+			o.schedule(machine, jobs, &timerJob{level: l, record: record}, t.event)
+		}
+	}
+	return nil
+}
+
+func (o *Scheduler) lookup(owner *StateMachine, record *TimerRecord) (level, *timer) {
+	if owner == nil {
+		return level{}, nil
+	}
+	s := owner.findState(record.State)
+	if s == nil {
+		return level{}, nil
+	}
+	for _, t := range owner.timers[s.ID()] {
+		if t.event.Desc == record.Event {
+			return level{state: s, machine: owner}, t
+		}
+	}
+	return level{}, nil
+}
+
+func (o *Scheduler) entityJobs(key timerKey) map[TimeoutEvent]*timerJob {
+	jobs := o.jobs[key]
+	if jobs == nil {
+		jobs = make(map[TimeoutEvent]*timerJob)
+		o.jobs[key] = jobs
+	}
+	return jobs
+}
+
+// update 取消不再活动（或者重新进入）的状态的计时，为活动的状态开始计时。
+// 持锁时只计算需要取消和开始的计时，deadline 回调以及 TimerStore 的读写在锁外执行
+func (o *Scheduler) update(c context.Context, machine *StateMachine, entity Entity, state IState, exited []level) {
+	active := activeLevels(state, machine)
+	key := timerKey{machine, entity.ID()}
+
+	type pending struct {
+		level level
+		timer *timer
+	}
+	stopped := make(map[TimeoutEvent]*timerJob)
+	var started []pending
+	o.lock.Lock()
+	jobs := o.entityJobs(key)
+	for event, job := range jobs {
+		if !contains(active, job.level) || contains(exited, job.level) {
+			job.stop()
+			delete(jobs, event)
+			stopped[event] = job
+		}
+	}
+	for _, l := range active {
+		for _, t := range l.machine.timers[l.state.ID()] {
+			if _, has := jobs[t.event]; !has {
+				started = append(started, pending{level: l, timer: t})
+			}
+		}
+	}
+	if len(jobs) == 0 {
+		delete(o.jobs, key)
+	}
+	o.lock.Unlock()
+
+	if o.store != nil {
+		for event, job := range stopped {
+			if err := o.store.Delete(c, job.record.Key); err != nil {
+				o.OnError(entity.ID(), event, err)
+			}
+		}
+	}
+
+	now := o.clock.Now()
+	var created []*timerJob
+	for _, p := range started {
+		l, t := p.level, p.timer
+		at := now.Add(t.after)
+		if t.deadline != nil {
+			at = t.deadline(c, entity)
+		}
+		record := &TimerRecord{
+			Key:      fmt.Sprintf("%s/%s/%v/%s/%d", machine.Name, entity.ID(), l.state.ID(), t.event.Desc, at.UnixNano()),
+			Machine:  machine.Name,
+			EntityID: entity.ID(),
+			Owner:    l.machine.Name,
+			State:    fmt.Sprint(l.state.ID()),
+			Event:    t.event.Desc,
+			At:       at,
+		}
+		if o.store != nil {
+			if err := o.store.Save(c, record); err != nil {
+				o.OnError(entity.ID(), t.event, err)
+			}
+		}
+		created = append(created, &timerJob{level: l, record: record, entity: entity})
+	}
+	if len(created) == 0 {
+		return
+	}
+
+	// 锁外的这段时间里其它 update 可能已经开始了相同的计时，这时删除多保存的记录
+	duplicated := make(map[TimeoutEvent]*timerJob)
+	o.lock.Lock()
+	jobs = o.entityJobs(key)
+	for i, job := range created {
+		event := started[i].timer.event
+		if _, has := jobs[event]; has {
+			duplicated[event] = job
+			continue
+		}
+		o.schedule(machine, jobs, job, event)
+	}
+	if len(jobs) == 0 {
+		delete(o.jobs, key)
+	}
+	o.lock.Unlock()
+
+	if o.store != nil {
+		for event, job := range duplicated {
+			if err := o.store.Delete(c, job.record.Key); err != nil {
+				o.OnError(entity.ID(), event, err)
+			}
+		}
+	}
+}
+
+func (o *Scheduler) schedule(machine *StateMachine, jobs map[TimeoutEvent]*timerJob, job *timerJob, event TimeoutEvent) {
+	delay := job.record.At.Sub(o.clock.Now())
+	if delay < 0 {
+		delay = 0
+	}
+	job.stop = o.clock.AfterFunc(delay, func() {
+		o.fire(machine, event, job)
+	})
+	jobs[event] = job
+}
+
+func (o *Scheduler) fire(machine *StateMachine, event TimeoutEvent, job *timerJob) {
+	key := timerKey{machine, job.record.EntityID}
+	o.lock.Lock()
+	if o.jobs[key][event] != job {
+		// 已经取消
+		o.lock.Unlock()
+		return
+	}
+	delete(o.jobs[key], event)
+	o.lock.Unlock()
+
+	c := context.WithValue(context.Background(), timerKeyCtx{}, job.record.Key)
+	entity, err := job.entity, error(nil)
+	if o.Loader != nil {
+		entity, err = o.Loader(c, machine, job.record.EntityID)
+	}
+	if err == nil {
+		err = machine.Trigger(c, entity, event)
+	}
+	if err != nil {
+		o.OnError(job.record.EntityID, event, err)
+	}
+
+	retry := err != nil && !errors.Is(err, ErrUnknownState) && !errors.Is(err, ErrUnknownEvent) && !errors.Is(err, ErrNoGuardPassed)
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	jobs := o.entityJobs(key)
+	if _, has := jobs[event]; retry && !has {
+		job.record.At = o.clock.Now().Add(o.RetryDelay)
+		if o.store != nil {
+			if err := o.store.Save(c, job.record); err != nil {
+				o.OnError(job.record.EntityID, event, err)
+			}
+		}
+		o.schedule(machine, jobs, job, event)
+		return
+	}
+	if len(jobs) == 0 {
+		delete(o.jobs, key)
+	}
+	if o.store != nil {
+		if err := o.store.Delete(c, job.record.Key); err != nil {
+			o.OnError(job.record.EntityID, event, err)
+		}
+	}
+}
+
+// activeLevels 实体处于的所有状态，包括外层的组合状态和每个并发区域的状态
+func activeLevels(state IState, def *StateMachine) []level {
+	leaves := []IState{state}
+	if c, ok := state.(*Configuration); ok {
+		leaves = c.Leaves()
+	}
+	var ls []level
+	for _, leaf := range leaves {
+		for _, l := range levels(leaf, def) {
+			if !contains(ls, l) {
+				ls = append(ls, l)
+			}
+		}
+	}
+	return ls
+}
+
+// exitedLevels 转换以及并发区域的转换中离开的状态
+func exitedLevels(trans *Transition, def *StateMachine) []level {
+	var ls []level
+	for _, s := range trans.Exited {
+		ls = append(ls, level{state: s, machine: machineOf(s, def)})
+	}
+	for _, branch := range trans.Branches {
+		ls = append(ls, exitedLevels(branch, def)...)
+	}
+	return ls
+}
+
+func contains(ls []level, l level) bool {
+	for _, x := range ls {
+		if x.is(l) {
+			return true
+		}
+	}
+	return false
+}
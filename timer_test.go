@@ -0,0 +1,111 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"testing"
+	"time"
+)
+
+func TestStateMachine_After(t *testing.T) {
+	clock := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	scheduler := NewScheduler(clock)
+	sm := NewMachine("TestStateMachine_After", Machines(nil), Timers(scheduler))
+	sm.Trans(sm.State("created").Exit("pay", ""), sm.State("paid").Entry(""))
+	sm.After(sm.State("created"), 30*time.Minute, "").Link(sm.State("cancelled").Entry(""))
+	sm.At(sm.State("paid"), func(ctx context.Context, entity Entity) time.Time {
+		return clock.Now().Add(time.Hour)
+	}, "").Link(sm.State("expired").Entry(""))
+	sm.After(sm.State("paid"), 2*time.Hour, "").Link(sm.State("closed").Entry(""))
+	sm.Show()
+
+	entity := NewMutableTestEntity("1", sm.State("created"))
+	sm.ScheduleTimers(context.Background(), entity)
+	pending := scheduler.Pending(sm, "1")
+	goassert.That(t, len(pending)).Equal(1)
+	goassert.That(t, pending[0].Event.Desc).Equal("after(30m0s)")
+	goassert.That(t, pending[0].At).Equal(clock.Now().Add(30 * time.Minute))
+
+	clock.Advance(29 * time.Minute)
+	goassert.That(t, entity.s.ID()).Equal("created")
+	clock.Advance(time.Minute)
+	goassert.That(t, entity.s.ID()).Equal("cancelled")
+	goassert.That(t, len(scheduler.Pending(sm, "1"))).Equal(0)
+
+	// 离开状态时取消计时
+	entity = NewMutableTestEntity("2", sm.State("created"))
+	sm.ScheduleTimers(context.Background(), entity)
+	clock.Advance(10 * time.Minute)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	goassert.That(t, len(scheduler.Pending(sm, "2"))).Equal(2)
+	clock.Advance(30 * time.Minute)
+	goassert.That(t, entity.s.ID()).Equal("paid")
+	clock.Advance(30 * time.Minute)
+	goassert.That(t, entity.s.ID()).Equal("expired")
+	goassert.That(t, len(scheduler.Pending(sm, "2"))).Equal(0)
+}
+
+func TestStateMachine_AfterResetAndGuardFailed(t *testing.T) {
+	clock := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	scheduler := NewScheduler(clock)
+	var failed []error
+	scheduler.OnError = func(entityID string, event Event, err error) {
+		failed = append(failed, err)
+	}
+	never := func(ctx context.Context, entity Entity, from, to IState) bool { return false }
+
+	sm := NewMachine("TestStateMachine_AfterResetAndGuardFailed", Machines(nil), Timers(scheduler))
+	sm.Trans(sm.State("s1").Exit("ping", ""), sm.State("s1").Entry(""))
+	sm.After(sm.State("s1"), 10*time.Minute, "").Link(sm.State("s2").Entry(""))
+	sm.After(sm.State("s2"), time.Minute, "never", never).Link(sm.State("s3").Entry(""))
+
+	entity := NewMutableTestEntity("1", sm.State("s1"))
+	sm.ScheduleTimers(context.Background(), entity)
+	clock.Advance(5 * time.Minute)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "ping")).Equal(nil)
+	clock.Advance(5 * time.Minute)
+	goassert.That(t, entity.s.ID()).Equal("s1")
+	clock.Advance(5 * time.Minute)
+	goassert.That(t, entity.s.ID()).Equal("s2")
+
+	clock.Advance(time.Minute)
+	goassert.That(t, entity.s.ID()).Equal("s2")
+	goassert.That(t, len(failed)).Equal(1)
+	goassert.That(t, errors.Is(failed[0], ErrNoGuardPassed)).Equal(true)
+}
+
+func TestStateMachine_AfterCompose(t *testing.T) {
+	var records []string
+	express := false
+	clock := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	scheduler := NewScheduler(clock)
+	sm := hsmMachine("TestStateMachine_AfterCompose", &records, &express)
+	sm.scheduler = scheduler
+	sm.After(sm.State("processing"), time.Hour, "").Link(sm.State("cancelled").Entry(""))
+
+	entity := NewMutableTestEntity("1", sm.State("created"))
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pay")).Equal(nil)
+	clock.Advance(30 * time.Minute)
+	goassert.That(t, sm.Trigger(context.Background(), entity, "pick")).Equal(nil)
+	goassert.That(t, entity.s.ID()).Equal("boxing")
+	clock.Advance(30 * time.Minute)
+	goassert.That(t, entity.s.ID()).Equal("cancelled")
+}
+
+func TestScheduler_UpdateCallbacks(t *testing.T) {
+	clock := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	scheduler := NewScheduler(clock)
+	sm := NewMachine("TestScheduler_UpdateCallbacks", Machines(nil), Timers(scheduler))
+	sm.At(sm.State("created"), func(ctx context.Context, entity Entity) time.Time {
+		// deadline 在锁外执行，可以访问 Scheduler
+		goassert.That(t, len(scheduler.Pending(sm, entity.ID()))).Equal(0)
+		return clock.Now().Add(time.Hour)
+	}, "").Link(sm.State("expired").Entry(""))
+
+	entity := NewMutableTestEntity("1", sm.State("created"))
+	sm.ScheduleTimers(context.Background(), entity)
+	goassert.That(t, len(scheduler.Pending(sm, "1"))).Equal(1)
+	clock.Advance(time.Hour)
+	goassert.That(t, entity.s.ID()).Equal("expired")
+}
@@ -0,0 +1,215 @@
+package gosm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TimerRecord 等待触发的定时事件。
+// Key 为幂等键，同一次计时重试、重启以后重新触发时保持不变，可以通过 TimerKey 在动作中获取
+type TimerRecord struct {
+	Key      string    `json:"key"`
+	Machine  string    `json:"machine"`
+	EntityID string    `json:"entity"`
+	Owner    string    `json:"owner"`
+	State    string    `json:"state"`
+	Event    string    `json:"event"`
+	At       time.Time `json:"at"`
+}
+
+// TimerStore 保存等待触发的定时事件，Scheduler 在开始计时时 Save，触发完成或者取消时 Delete
+type TimerStore interface {
+	Save(ctx context.Context, record *TimerRecord) error
+	Delete(ctx context.Context, key string) error
+	// List 按照触发时间排序
+	List(ctx context.Context) ([]*TimerRecord, error)
+}
+
+type timerKeyCtx struct{}
+
+// TimerKey 定时事件触发的 Trigger 中获取幂等键
+func TimerKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(timerKeyCtx{}).(string)
+	return key, ok
+}
+
+//---------------------------------------------------------------------------------
+
+// FileTimerStore 保存在本地文件中的 TimerStore。每次修改追加一行 JSON 并 Sync，打开时重放所有修改
+type FileTimerStore struct {
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	records map[string]*TimerRecord
+}
+
+type timerOp struct {
+	Op     string       `json:"op"`
+	Key    string       `json:"key,omitempty"`
+	Record *TimerRecord `json:"record,omitempty"`
+}
+
+func NewFileTimerStore(path string) (*FileTimerStore, error) {
+	store := &FileTimerStore{path: path, records: make(map[string]*TimerRecord)}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	store.file = file
+	return store, nil
+}
+
+// load 重放所有修改。最后一行没有换行或者不是完整的 JSON 时是写入中断留下的，截断以后继续；
+// 其它位置的错误说明文件已经损坏，返回错误
+func (o *FileTimerStore) load() error {
+	data, err := os.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	offset := 0
+	for line := 1; offset < len(data); line++ {
+		end := bytes.IndexByte(data[offset:], '\n')
+		tail := end < 0 || offset+end+1 == len(data)
+		if end < 0 {
+			end = len(data) - offset
+		}
+		op := &timerOp{}
+		err := json.Unmarshal(data[offset:offset+end], op)
+		if tail && (err != nil || offset+end == len(data)) {
+			log.Printf("%s:%d: 截断不完整的记录", o.path, line)
+			return os.Truncate(o.path, int64(offset))
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", o.path, line, err)
+		}
+		switch {
+		case op.Op == "save" && op.Record != nil:
+			o.records[op.Record.Key] = op.Record
+		case op.Op == "delete":
+			delete(o.records, op.Key)
+		default:
+			return fmt.Errorf("%s:%d: 无法识别的记录", o.path, line)
+		}
+		offset += end + 1
+	}
+	return nil
+}
+
+func (o *FileTimerStore) append(op *timerOp) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if _, err := o.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return o.file.Sync()
+}
+
+func (o *FileTimerStore) Save(ctx context.Context, record *TimerRecord) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if err := o.append(&timerOp{Op: "save", Record: record}); err != nil {
+		return err
+	}
+	copied := *record
+	o.records[record.Key] = &copied
+	return nil
+}
+
+func (o *FileTimerStore) Delete(ctx context.Context, key string) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if _, has := o.records[key]; !has {
+		return nil
+	}
+	if err := o.append(&timerOp{Op: "delete", Key: key}); err != nil {
+		return err
+	}
+	delete(o.records, key)
+	return nil
+}
+
+func (o *FileTimerStore) List(ctx context.Context) ([]*TimerRecord, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.list(), nil
+}
+
+func (o *FileTimerStore) list() []*TimerRecord {
+	var records []*TimerRecord
+	for _, record := range o.records {
+		copied := *record
+		records = append(records, &copied)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].At.Equal(records[j].At) {
+			return records[i].Key < records[j].Key
+		}
+		return records[i].At.Before(records[j].At)
+	})
+	return records
+}
+
+// Compact 只保留等待触发的记录，写入临时文件以后替换原文件。
+// 失败时原文件和正在使用的文件句柄保持不变
+func (o *FileTimerStore) Compact() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	tmp := o.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err := o.rewrite(file, tmp); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// file 在改名以后指向新文件，直接作为追加的文件句柄
+	o.file.Close()
+	o.file = file
+	return nil
+}
+
+func (o *FileTimerStore) rewrite(file *os.File, tmp string) error {
+	writer := bufio.NewWriter(file)
+	for _, record := range o.list() {
+		data, err := json.Marshal(&timerOp{Op: "save", Record: record})
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.path)
+}
+
+func (o *FileTimerStore) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.file.Close()
+}
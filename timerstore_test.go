@@ -0,0 +1,150 @@
+package gosm
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileTimerStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timers.log")
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store, err := NewFileTimerStore(path)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, store.Save(context.Background(), &TimerRecord{Key: "k2", At: at.Add(time.Hour)})).Equal(nil)
+	goassert.That(t, store.Save(context.Background(), &TimerRecord{Key: "k1", At: at})).Equal(nil)
+	goassert.That(t, store.Save(context.Background(), &TimerRecord{Key: "k3", At: at})).Equal(nil)
+	goassert.That(t, store.Delete(context.Background(), "k3")).Equal(nil)
+	goassert.That(t, store.Delete(context.Background(), "k9")).Equal(nil)
+	goassert.That(t, store.Close()).Equal(nil)
+
+	keys := func(store TimerStore) []string {
+		records, err := store.List(context.Background())
+		goassert.That(t, err).Equal(nil)
+		var keys []string
+		for _, r := range records {
+			keys = append(keys, r.Key)
+		}
+		return keys
+	}
+
+	store, err = NewFileTimerStore(path)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, keys(store)).Equal([]string{"k1", "k2"})
+
+	goassert.That(t, store.Compact()).Equal(nil)
+	data, _ := os.ReadFile(path)
+	goassert.That(t, strings.Count(string(data), "\n")).Equal(2)
+	goassert.That(t, store.Delete(context.Background(), "k1")).Equal(nil)
+	goassert.That(t, store.Close()).Equal(nil)
+
+	store, err = NewFileTimerStore(path)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, keys(store)).Equal([]string{"k2"})
+	goassert.That(t, store.Close()).Equal(nil)
+
+	goassert.That(t, os.WriteFile(path, []byte("{\"op\":\"save\"}\n"), 0644)).Equal(nil)
+	_, err = NewFileTimerStore(path)
+	goassert.That(t, err).NotEqual(nil)
+	// 写入中断留下的最后一行被截断
+	saved := "{\"op\":\"save\",\"record\":{\"key\":\"k1\"}}\n"
+	goassert.That(t, os.WriteFile(path, []byte(saved+"{\"op\":\"save\",\"rec"), 0644)).Equal(nil)
+	store, err = NewFileTimerStore(path)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, keys(store)).Equal([]string{"k1"})
+	goassert.That(t, store.Delete(context.Background(), "k1")).Equal(nil)
+	goassert.That(t, store.Close()).Equal(nil)
+	store, err = NewFileTimerStore(path)
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, len(keys(store))).Equal(0)
+	goassert.That(t, store.Close()).Equal(nil)
+
+	goassert.That(t, os.WriteFile(path, []byte("{\"op\":\"save\",\"rec\n"+saved), 0644)).Equal(nil)
+	_, err = NewFileTimerStore(path)
+	goassert.That(t, err).NotEqual(nil)
+}
+
+func timerStoreMachine(clock Clock, scheduler *Scheduler, fail *int, keys *[]string) *StateMachine {
+	sm := NewMachine("TestScheduler_Restore", Machines(nil), Timers(scheduler))
+	sm.Trans(sm.State("created").Exit("pay", ""), sm.State("paid").Entry(""))
+	sm.After(sm.State("created"), 30*time.Minute, "").Link(sm.State("cancelled").Entry("", func(ctx context.Context, entity Entity, from, to IState) error {
+		key, _ := TimerKey(ctx)
+		*keys = append(*keys, key)
+		if *fail > 0 {
+			*fail--
+			return errors.New("cancel")
+		}
+		return nil
+	}))
+	return sm
+}
+
+func TestScheduler_Restore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timers.log")
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	entities := map[string]*MutableTestEntity{
+		"1": NewMutableTestEntity("1", State("created")),
+		"2": NewMutableTestEntity("2", State("created")),
+	}
+	loader := func(ctx context.Context, machine *StateMachine, entityID string) (Entity, error) {
+		if e, ok := entities[entityID]; ok {
+			return e, nil
+		}
+		return nil, errors.New("not found")
+	}
+	fail := 0
+	var keys []string
+
+	store, err := NewFileTimerStore(path)
+	goassert.That(t, err).Equal(nil)
+	clock := NewManualClock(start)
+	scheduler := NewScheduler(clock).Store(store)
+	scheduler.Loader = loader
+	sm := timerStoreMachine(clock, scheduler, &fail, &keys)
+	for _, entity := range entities {
+		entity.s = sm.State("created")
+		sm.ScheduleTimers(context.Background(), entity)
+	}
+	goassert.That(t, sm.Trigger(context.Background(), entities["2"], "pay")).Equal(nil)
+	goassert.That(t, store.Close()).Equal(nil)
+
+	// 重启
+	store, err = NewFileTimerStore(path)
+	goassert.That(t, err).Equal(nil)
+	records, _ := store.List(context.Background())
+	goassert.That(t, len(records)).Equal(1)
+	goassert.That(t, records[0].EntityID).Equal("1")
+	goassert.That(t, store.Save(context.Background(), &TimerRecord{
+		Key: "unknown", Machine: "TestScheduler_Restore", EntityID: "1", Owner: "TestScheduler_Restore", State: "nope", At: start,
+	})).Equal(nil)
+
+	entities["1"].s = State("created")
+	clock = NewManualClock(start.Add(time.Hour))
+	scheduler = NewScheduler(clock).Store(store)
+	sm = timerStoreMachine(clock, scheduler, &fail, &keys)
+	goassert.That(t, scheduler.Restore(context.Background(), sm)).NotEqual(nil)
+	scheduler.Loader = loader
+	fail = 1
+	goassert.That(t, scheduler.Restore(context.Background(), sm)).Equal(nil)
+	goassert.That(t, len(scheduler.Pending(sm, "1"))).Equal(1)
+
+	// 第一次失败以后使用相同的幂等键重试
+	clock.Advance(0)
+	goassert.That(t, entities["1"].s.ID()).Equal("created")
+	goassert.That(t, len(keys)).Equal(1)
+	records, _ = store.List(context.Background())
+	goassert.That(t, len(records)).Equal(1)
+	goassert.That(t, records[0].At).Equal(start.Add(time.Hour + time.Minute))
+
+	clock.Advance(time.Minute)
+	goassert.That(t, entities["1"].s.ID()).Equal("cancelled")
+	goassert.That(t, keys[1]).Equal(keys[0])
+	records, _ = store.List(context.Background())
+	goassert.That(t, len(records)).Equal(0)
+	goassert.That(t, store.Close()).Equal(nil)
+}
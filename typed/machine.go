@@ -0,0 +1,183 @@
+// Package typed 基于 gosm.StateMachine 的泛型状态机，状态、事件、实体在编译期检查类型
+package typed
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/threeq/gosm"
+)
+
+type Entity[S comparable] interface {
+	ID() string
+	State() S
+}
+
+// MutableEntity 进入状态的动作执行成功以后自动调用 SetState，见 gosm.MutableEntity
+type MutableEntity[S comparable] interface {
+	Entity[S]
+	SetState(state S)
+}
+
+type Condition[S comparable, T Entity[S]] func(ctx context.Context, entity T, from, to S) bool
+type Action[S comparable, T Entity[S]] func(ctx context.Context, entity T, from, to S) error
+
+type Machine[S comparable, E comparable, T Entity[S]] struct {
+	sm     *gosm.StateMachine
+	states map[S]gosm.IState
+}
+
+func NewMachine[S comparable, E comparable, T Entity[S]](name string, options ...gosm.Option) *Machine[S, E, T] {
+	return &Machine[S, E, T]{sm: gosm.NewMachine(name, options...), states: make(map[S]gosm.IState)}
+}
+
+// Core 底层的 gosm.StateMachine
+func (o *Machine[S, E, T]) Core() *gosm.StateMachine {
+	return o.sm
+}
+
+// state 定义时创建并记录状态，Trigger 时按 S 找回绑定了状态机的状态
+func (o *Machine[S, E, T]) state(s S) gosm.IState {
+	state, has := o.states[s]
+	if !has {
+		state = o.sm.State(s)
+		o.states[s] = state
+	}
+	return state
+}
+
+// mutable fork 以后的 Configuration、结束状态 [*] 不能用 S 表示，T 实现 MutableEntity 时无法更新实体状态
+func (o *Machine[S, E, T]) mutable(op string) {
+	var entity T
+	if _, ok := any(entity).(MutableEntity[S]); ok {
+		panic(fmt.Sprintf("%T 实现了 MutableEntity，%s 以后的状态不能用 S 表示", entity, op))
+	}
+}
+
+type Exit[S comparable, E comparable, T Entity[S]] struct {
+	exit *gosm.StateExit
+}
+
+type Entry[S comparable, T Entity[S]] struct {
+	entry gosm.StateEntry
+}
+
+func (o *Machine[S, E, T]) Exit(from S, event E, desc string, condition ...Condition[S, T]) Exit[S, E, T] {
+	var conditions []gosm.Condition
+	for _, cond := range condition {
+		conditions = append(conditions, wrapCondition(cond))
+	}
+	return Exit[S, E, T]{o.state(from).Exit(event, desc, conditions...)}
+}
+
+func (o *Machine[S, E, T]) Entry(to S, desc string, actions ...Action[S, T]) Entry[S, T] {
+	return Entry[S, T]{o.state(to).Entry(desc, wrapActions(actions)...)}
+}
+
+func (o *Machine[S, E, T]) Trans(from Exit[S, E, T], to Entry[S, T]) {
+	o.sm.Trans(from.exit, to.entry)
+}
+
+// End 转换到结束状态，动作中的 to 为 S 的零值。T 实现 MutableEntity 时 panic
+func (o *Machine[S, E, T]) End(from Exit[S, E, T], actions ...Action[S, T]) {
+	o.mutable("End")
+	from.exit.End(wrapActions(actions)...)
+}
+
+// Internal 内部转换，只执行动作，不离开、不进入状态
+func (o *Machine[S, E, T]) Internal(from Exit[S, E, T], desc string, actions ...Action[S, T]) {
+	o.sm.Internal(from.exit, desc, wrapActions(actions)...)
+}
+
+// Fork 并行进入 to 中的状态，实体的状态由动作维护。T 实现 MutableEntity 时 panic
+func (o *Machine[S, E, T]) Fork(from Exit[S, E, T], executor gosm.Executor, to ...Entry[S, T]) {
+	o.mutable("Fork")
+	var entries []gosm.StateEntry
+	for _, entry := range to {
+		entries = append(entries, entry.entry)
+	}
+	o.sm.Fork(from.exit).Link(executor, entries...)
+}
+
+// OnEntry 从任何状态进入 s 时执行的动作
+func (o *Machine[S, E, T]) OnEntry(s S, actions ...Action[S, T]) {
+	o.sm.OnEntry(o.state(s), wrapActions(actions)...)
+}
+
+// OnExit 因为任何事件离开 s 时执行的动作
+func (o *Machine[S, E, T]) OnExit(s S, actions ...Action[S, T]) {
+	o.sm.OnExit(o.state(s), wrapActions(actions)...)
+}
+
+// Defer 实体处于 s 时延迟没有转换处理的 events，进入处理它们的状态以后重新分发
+func (o *Machine[S, E, T]) Defer(s S, events ...E) {
+	var deferred []gosm.Event
+	for _, event := range events {
+		deferred = append(deferred, event)
+	}
+	o.sm.Defer(o.state(s), deferred...)
+}
+
+func (o *Machine[S, E, T]) Trigger(ctx context.Context, entity T, event E) error {
+	return o.sm.Trigger(ctx, &entityAdapter[S, T]{entity: entity, states: o.states}, event)
+}
+
+//---------------------------------------------------------------------------------
+
+// entityAdapter 把 T 适配为 gosm.MutableEntity
+type entityAdapter[S comparable, T Entity[S]] struct {
+	entity T
+	states map[S]gosm.IState
+}
+
+func (o *entityAdapter[S, T]) ID() string {
+	return o.entity.ID()
+}
+
+// State 没有定义过的状态不绑定状态机，Trigger 返回 ErrUnknownState
+func (o *entityAdapter[S, T]) State() gosm.IState {
+	if state, has := o.states[o.entity.State()]; has {
+		return state
+	}
+	return gosm.State(o.entity.State())
+}
+
+// SetState Fork、End 拒绝了 MutableEntity，这里只会收到 S 的状态
+func (o *entityAdapter[S, T]) SetState(state gosm.IState) {
+	if mutable, ok := any(o.entity).(MutableEntity[S]); ok {
+		if s, ok := state.ID().(S); ok {
+			mutable.SetState(s)
+		}
+	}
+}
+
+// unwrap Filter.Before 可能替换实体，这时直接按 T 断言
+func unwrap[S comparable, T Entity[S]](entity gosm.Entity) T {
+	if adapter, ok := entity.(*entityAdapter[S, T]); ok {
+		return adapter.entity
+	}
+	return entity.(T)
+}
+
+// stateOf 结束状态、fork 等伪状态的 ID 不是 S，返回零值
+func stateOf[S comparable](state gosm.IState) S {
+	s, _ := state.ID().(S)
+	return s
+}
+
+func wrapCondition[S comparable, T Entity[S]](cond Condition[S, T]) gosm.Condition {
+	return func(ctx context.Context, entity gosm.Entity, from, to gosm.IState) bool {
+		return cond(ctx, unwrap[S, T](entity), stateOf[S](from), stateOf[S](to))
+	}
+}
+
+func wrapActions[S comparable, T Entity[S]](actions []Action[S, T]) []gosm.Action {
+	var wrapped []gosm.Action
+	for _, action := range actions {
+		action := action
+		wrapped = append(wrapped, func(ctx context.Context, entity gosm.Entity, from, to gosm.IState) error {
+			return action(ctx, unwrap[S, T](entity), stateOf[S](from), stateOf[S](to))
+		})
+	}
+	return wrapped
+}
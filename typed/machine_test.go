@@ -0,0 +1,177 @@
+package typed
+
+import (
+	"context"
+	"errors"
+	"github.com/threeq/goassert"
+	"github.com/threeq/gosm"
+	"testing"
+)
+
+type orderState int
+type orderEvent string
+
+const (
+	created orderState = iota + 1
+	paid
+	shipped
+	invoiced
+)
+
+type order struct {
+	id     string
+	state  orderState
+	amount int
+	log    []orderState
+}
+
+func (o *order) ID() string {
+	return o.id
+}
+
+func (o *order) State() orderState {
+	return o.state
+}
+
+func (o *order) SetState(state orderState) {
+	o.state = state
+}
+
+func orderMachine(t *testing.T) *Machine[orderState, orderEvent, *order] {
+	m := NewMachine[orderState, orderEvent, *order](t.Name(), gosm.Machines(nil))
+	record := func(ctx context.Context, entity *order, from, to orderState) error {
+		entity.log = append(entity.log, to)
+		return nil
+	}
+	m.Trans(m.Exit(created, "pay", "amount>0", func(ctx context.Context, entity *order, from, to orderState) bool {
+		return entity.amount > 0
+	}), m.Entry(paid, "record", record))
+	m.Trans(m.Exit(paid, "ship", ""), m.Entry(shipped, "record", record))
+	m.Trans(m.Exit(shipped, "invoice", ""), m.Entry(invoiced, "record", record))
+	return m
+}
+
+func TestMachine_Trigger(t *testing.T) {
+	m := orderMachine(t)
+
+	o := &order{id: "1", state: created}
+	err := m.Trigger(context.Background(), o, "pay")
+	goassert.That(t, errors.Is(err, gosm.ErrNoGuardPassed)).Equal(true)
+
+	o.amount = 10
+	goassert.That(t, m.Trigger(context.Background(), o, "pay")).Equal(nil)
+	goassert.That(t, o.state).Equal(paid)
+
+	goassert.That(t, m.Trigger(context.Background(), o, "ship")).Equal(nil)
+	goassert.That(t, o.state).Equal(shipped)
+	goassert.That(t, o.log).Equal([]orderState{paid, shipped})
+
+	err = m.Trigger(context.Background(), &order{id: "2", state: invoiced}, "pay")
+	goassert.That(t, errors.Is(err, gosm.ErrUnknownState)).Equal(true)
+	goassert.That(t, m.Core().Name).Equal(t.Name())
+
+	adapter := &entityAdapter[orderState, *order]{entity: o, states: m.states}
+	goassert.That(t, adapter.State().Machine()).Equal(m.Core())
+}
+
+// ticket 不实现 MutableEntity，状态由动作维护
+type ticket struct {
+	id    string
+	state orderState
+	log   []orderState
+}
+
+func (o *ticket) ID() string {
+	return o.id
+}
+
+func (o *ticket) State() orderState {
+	return o.state
+}
+
+func TestMachine_Fork(t *testing.T) {
+	m := NewMachine[orderState, orderEvent, *ticket](t.Name(), gosm.Machines(nil))
+	record := func(ctx context.Context, entity *ticket, from, to orderState) error {
+		entity.log = append(entity.log, to)
+		return nil
+	}
+	m.Fork(m.Exit(paid, "ship", ""), gosm.Serial(gosm.All), m.Entry(shipped, "record", record), m.Entry(invoiced, "record", record))
+	m.End(m.Exit(shipped, "close", ""), func(ctx context.Context, entity *ticket, from, to orderState) error {
+		entity.state = to
+		return nil
+	})
+
+	o := &ticket{id: "1", state: paid}
+	goassert.That(t, m.Trigger(context.Background(), o, "ship")).Equal(nil)
+	goassert.That(t, o.log).Equal([]orderState{shipped, invoiced})
+
+	o.state = shipped
+	goassert.That(t, m.Trigger(context.Background(), o, "close")).Equal(nil)
+	goassert.That(t, o.state).Equal(orderState(0))
+}
+
+func TestMachine_ForkMutable(t *testing.T) {
+	m := orderMachine(t)
+	panics := func(f func()) (recovered interface{}) {
+		defer func() {
+			recovered = recover()
+		}()
+		f()
+		return nil
+	}
+	goassert.That(t, panics(func() {
+		m.Fork(m.Exit(paid, "split", ""), gosm.Serial(gosm.All), m.Entry(shipped, ""), m.Entry(invoiced, ""))
+	})).NotEqual(nil)
+	goassert.That(t, panics(func() {
+		m.End(m.Exit(invoiced, "close", ""))
+	})).NotEqual(nil)
+}
+
+func TestMachine_OnEntry(t *testing.T) {
+	m := orderMachine(t)
+	var steps []string
+	m.OnExit(created, func(ctx context.Context, entity *order, from, to orderState) error {
+		steps = append(steps, "exit created")
+		return nil
+	})
+	m.OnEntry(paid, func(ctx context.Context, entity *order, from, to orderState) error {
+		steps = append(steps, "entry paid")
+		goassert.That(t, entity.log).Equal([]orderState{paid})
+		return nil
+	})
+
+	o := &order{id: "1", state: created, amount: 10}
+	goassert.That(t, m.Trigger(context.Background(), o, "pay")).Equal(nil)
+	goassert.That(t, steps).Equal([]string{"exit created", "entry paid"})
+}
+
+func TestMachine_Internal(t *testing.T) {
+	m := orderMachine(t)
+	var steps []string
+	m.Internal(m.Exit(created, "remind", ""), "remind", func(ctx context.Context, entity *order, from, to orderState) error {
+		steps = append(steps, "remind")
+		return nil
+	})
+	m.OnExit(created, func(ctx context.Context, entity *order, from, to orderState) error {
+		steps = append(steps, "exit created")
+		return nil
+	})
+
+	o := &order{id: "1", state: created, amount: 10}
+	goassert.That(t, m.Trigger(context.Background(), o, "remind")).Equal(nil)
+	goassert.That(t, o.state).Equal(created)
+	goassert.That(t, steps).Equal([]string{"remind"})
+}
+
+func TestMachine_Defer(t *testing.T) {
+	m := orderMachine(t)
+	m.Defer(created, "ship")
+	o := &order{id: "1", state: created, amount: 10}
+	goassert.That(t, m.Trigger(context.Background(), o, "ship")).Equal(nil)
+	goassert.That(t, m.Core().Deferred("1")).Equal([]gosm.Event{orderEvent("ship")})
+
+	goassert.That(t, m.Trigger(context.Background(), o, "pay")).Equal(nil)
+	goassert.That(t, o.log).Equal([]orderState{paid, shipped})
+	goassert.That(t, o.state).Equal(shipped)
+	goassert.That(t, len(m.Core().Deferred("1"))).Equal(0)
+}
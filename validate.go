@@ -0,0 +1,239 @@
+package gosm
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type Severity int
+
+const (
+	Warning Severity = iota
+	Error
+)
+
+func (o Severity) String() string {
+	if o == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+// 问题类型
+const (
+	ProblemUnreachable   = "unreachable"
+	ProblemDeadEnd       = "dead-end"
+	ProblemEmptyFork     = "empty-fork"
+	ProblemShadowedGuard = "shadowed-guard"
+	ProblemUndefinedLink = "undefined-link"
+	ProblemNoInitial     = "no-initial"
+)
+
+type Problem struct {
+	Severity Severity
+	Code     string
+	State    interface{}
+	Event    Event
+	Msg      string
+}
+
+func (o *Problem) String() string {
+	return fmt.Sprintf("%s[%s] %v: %s", o.Severity, o.Code, o.State, o.Msg)
+}
+
+type Problems []*Problem
+
+func (o Problems) Errors() Problems {
+	return o.filter(Error)
+}
+
+func (o Problems) Warnings() Problems {
+	return o.filter(Warning)
+}
+
+func (o Problems) filter(severity Severity) Problems {
+	var problems Problems
+	for _, p := range o {
+		if p.Severity == severity {
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// Err 存在 Error 级别的问题时返回 *ValidationError
+func (o Problems) Err() error {
+	if errs := o.Errors(); len(errs) > 0 {
+		return &ValidationError{Problems: errs}
+	}
+	return nil
+}
+
+type ValidationError struct {
+	Problems Problems
+}
+
+func (o *ValidationError) Error() string {
+	var lines []string
+	for _, p := range o.Problems {
+		lines = append(lines, p.String())
+	}
+	return "状态机校验失败: " + strings.Join(lines, "; ")
+}
+
+// Validate 静态检查状态机定义：
+//
+//	Error   fork 没有分支；choice 中 Any 条件后面的条件永远不会被检查；链接的子状态机没有定义入口状态；
+//	        组合状态的子状态机没有开始状态
+//	Warning 从开始状态无法到达的状态（没有开始状态时以没有入口的状态作为开始，都有入口时不检查）；
+//	        不是结束状态、也不是汇合完成状态，但是没有出口的状态
+func (o *StateMachine) Validate() Problems {
+	var problems Problems
+	add := func(severity Severity, code string, state interface{}, event Event, format string, args ...interface{}) {
+		problems = append(problems, &Problem{
+			Severity: severity, Code: code, State: state, Event: event, Msg: fmt.Sprintf(format, args...),
+		})
+	}
+
+	states := make(map[interface{}]bool)
+	edges := make(map[interface{}][]interface{})
+	incoming := make(map[interface{}]bool)
+	for id, s := range o.states {
+		if !isPseudoState(s) {
+			states[id] = true
+		}
+	}
+
+	target := func(from interface{}, event Event, entry StateEntry) {
+		if history, ok := entry.(*historyStateEntry); ok {
+			if len(history.machine.starts) == 0 {
+				add(Error, ProblemUndefinedLink, from, event,
+					"历史入口的状态机 %s 没有开始状态", history.machine.Name)
+			}
+			return
+		}
+		to := entry.State()
+		if to.Machine() != nil && to.Machine() != o {
+			if !to.Machine().defines(to) {
+				add(Error, ProblemUndefinedLink, from, event,
+					"链接的状态机 %s 没有定义状态 %v", to.Machine().Name, to.ID())
+			}
+			return
+		}
+		states[to.ID()] = true
+		incoming[to.ID()] = true
+		edges[from] = append(edges[from], to.ID())
+	}
+
+	// 结束状态和汇合的完成状态没有出口是正常的
+	finals := make(map[interface{}]bool)
+	for _, s := range o.ends {
+		finals[s.ID()] = true
+	}
+
+	shadowed := make(map[*ConditionLinker]bool)
+	for _, linker := range o.linkers {
+		from, event := linker.exit.state.ID(), linker.exit.event
+		if combo, ok := linker.entry.(*comboStateEntry); ok {
+			if len(combo.stateEntries) == 0 {
+				add(Error, ProblemEmptyFork, from, event, "fork %v 没有分支", event)
+			}
+			for _, entry := range combo.stateEntries {
+				target(from, event, entry)
+			}
+			if combo.join != nil {
+				for _, f := range combo.join.finals {
+					finals[f.ID()] = true
+				}
+			}
+			if combo.join != nil && combo.join.entry != nil {
+				for _, f := range combo.join.finals {
+					target(f.ID(), nil, combo.join.entry)
+				}
+			}
+		} else {
+			target(from, event, linker.entry)
+		}
+
+		choices := o.transitions[from][event]
+		for i, trans := range choices[:len(choices)-1] {
+			if isAny(trans.exit) {
+				if !shadowed[trans] {
+					shadowed[trans] = true
+					add(Error, ProblemShadowedGuard, from, event,
+						"事件 %v 的第 %d 个条件为 Any，后面的 %d 个条件永远不会被检查", event, i+1, len(choices)-i-1)
+				}
+				break
+			}
+		}
+	}
+
+	for _, s := range o.States() {
+		if sub := o.children[s.ID()]; sub != nil && len(sub.starts) == 0 {
+			add(Error, ProblemNoInitial, s.ID(), nil, "组合状态 %v 的子状态机 %s 没有开始状态", s.ID(), sub.Name)
+		}
+	}
+
+	// 可达性
+	var roots []interface{}
+	for _, s := range o.starts {
+		roots = append(roots, s.ID())
+	}
+	if len(roots) == 0 {
+		for id := range states {
+			if !incoming[id] {
+				roots = append(roots, id)
+			}
+		}
+	}
+	// 没有开始状态并且所有状态都有入口（例如只有环）时无法判断可达性
+	checkReach := len(roots) > 0
+	reached := make(map[interface{}]bool)
+	for len(roots) > 0 {
+		id := roots[len(roots)-1]
+		roots = roots[:len(roots)-1]
+		if reached[id] {
+			continue
+		}
+		reached[id] = true
+		roots = append(roots, edges[id]...)
+	}
+
+	var ids []interface{}
+	for id := range states {
+		if id != "[*]" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return fmt.Sprint(ids[i]) < fmt.Sprint(ids[j])
+	})
+	for _, id := range ids {
+		if checkReach && !reached[id] {
+			add(Warning, ProblemUnreachable, id, nil, "状态 %v 无法到达", id)
+		}
+		if _, has := o.transitions[id]; !has && !finals[id] {
+			add(Warning, ProblemDeadEnd, id, nil, "状态 %v 没有出口", id)
+		}
+	}
+	return problems
+}
+
+// defines 状态是开始状态或者有出口
+func (o *StateMachine) defines(s IState) bool {
+	if _, has := o.transitions[s.ID()]; has {
+		return true
+	}
+	for _, start := range o.starts {
+		if start.ID() == s.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+func isAny(exit *StateExit) bool {
+	return reflect.ValueOf(exit.cond).Pointer() == reflect.ValueOf(Any).Pointer()
+}
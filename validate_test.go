@@ -0,0 +1,90 @@
+package gosm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/threeq/goassert"
+	"testing"
+)
+
+func TestStateMachine_Validate(t *testing.T) {
+	sub := NewMachine("TestStateMachine_Validate_sub", Machines(nil))
+	sub.Trans(sub.State("x1").Exit("e1", ""), sub.State("x2").Entry(""))
+
+	sm := NewMachine("TestStateMachine_Validate", Machines(nil))
+	sm.Entry(sm.State("s1"), "")
+	sm.Trans(State("s1").Exit("e1", "Any", Any), State("s2").Entry(""))
+	sm.Trans(State("s1").Exit("e1", "never", Any), State("s3").Entry(""))
+	sm.Trans(State("s2").Exit("e2", ""), sub.State("x1").Entry(""))
+	sm.Trans(State("s2").Exit("e3", ""), sub.State("x9").Entry(""))
+	sm.Fork(State("s2").Exit("e4", "")).Link(Serial(All))
+	sm.Trans(State("u1").Exit("e1", ""), State("u2").Entry(""))
+	sm.Trans(State("u2").Exit("e1", ""), State("u1").Entry(""))
+	sm.Show()
+
+	problems := sm.Validate()
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.Code+":"+p.State.(string))
+	}
+	goassert.That(t, got).Equal([]string{
+		ProblemShadowedGuard + ":s1",
+		ProblemUndefinedLink + ":s2",
+		ProblemEmptyFork + ":s2",
+		ProblemDeadEnd + ":s3",
+		ProblemUnreachable + ":u1",
+		ProblemUnreachable + ":u2",
+	})
+	goassert.That(t, len(problems.Errors())).Equal(3)
+	goassert.That(t, len(problems.Warnings())).Equal(3)
+
+	var validationErr *ValidationError
+	goassert.That(t, errors.As(problems.Err(), &validationErr)).Equal(true)
+	goassert.That(t, validationErr.Problems).Equal(problems.Errors())
+}
+
+func TestBuilder_Strict(t *testing.T) {
+	registry := NewMachineRegistry()
+	builder := NewBuilder().Machines(registry).Strict(true)
+	goassert.That(t, builder.DSL("s1 -> s2 : e1\ns1 -> s3 : e1")).Equal(nil)
+
+	_, err := builder.TryBuild("TestBuilder_Strict")
+	var validationErr *ValidationError
+	goassert.That(t, errors.As(err, &validationErr)).Equal(true)
+	goassert.That(t, registry.Get("TestBuilder_Strict") == nil).Equal(true)
+
+	goassert.That(t, builder.DSL("s1 -> s2 : e1\ns2 -> s3 : e1")).Equal(nil)
+	sm, err := builder.TryBuild("TestBuilder_Strict")
+	goassert.That(t, err).Equal(nil)
+	goassert.That(t, len(sm.Validate().Warnings())).Equal(1)
+}
+
+func TestStateMachine_ValidateFinals(t *testing.T) {
+	codes := func(problems Problems) []string {
+		var got []string
+		for _, p := range problems {
+			got = append(got, p.Code+":"+fmt.Sprint(p.State))
+		}
+		return got
+	}
+
+	// 汇合的完成状态 done、shipped 不是死状态
+	sm := joinMachine("TestStateMachine_ValidateFinals", 0, nil)
+	goassert.That(t, codes(sm.Validate())).Equal([]string{
+		ProblemDeadEnd + ":closed",
+		ProblemDeadEnd + ":packed",
+	})
+
+	// 只有环、没有开始状态时不检查可达性
+	sm = NewMachine("TestStateMachine_ValidateFinals_cycle", Machines(nil))
+	sm.Trans(State("s1").Exit("e1", ""), State("s2").Entry(""))
+	sm.Trans(State("s2").Exit("e2", ""), State("s1").Entry(""))
+	goassert.That(t, len(sm.Validate())).Equal(0)
+
+	// 结束状态不是死状态
+	sm = NewMachine("TestStateMachine_ValidateFinals_ends", Machines(nil))
+	sm.Entry(sm.State("s1"), "")
+	sm.Trans(State("s1").Exit("e1", ""), State("s2").Entry(""))
+	sm.Exit(sm.State("s2"), "e2", "")
+	goassert.That(t, len(sm.Validate())).Equal(0)
+}